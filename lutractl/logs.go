@@ -0,0 +1,87 @@
+package main
+
+import (
+	"dev.sigpipe.me/dashie/lutrainit/shared/ipc"
+	"errors"
+	"fmt"
+	"github.com/urfave/cli"
+	"time"
+)
+
+// CmdLogs CLI object
+var CmdLogs = cli.Command{
+	Name:        "logs",
+	Usage:       "Shows services output",
+	Description: "Shows the output of the given services, or of all of them",
+	Action:      getLogs,
+	Flags: []cli.Flag{
+		cli.IntFlag{Name: "n, lines", Value: 20, Usage: "Number of lines to show, 0 for all of them"},
+		cli.StringFlag{Name: "since", Usage: "Only lines since '2006-01-02 15:04:05', '2006-01-02' or a duration ago like '10m'"},
+		cli.BoolFlag{Name: "f, follow", Usage: "Wait for new lines until interrupted"},
+	},
+}
+
+// followInterval is how often new lines are asked in follow mode
+const followInterval = 500 * time.Millisecond
+
+func getLogs(ctx *cli.Context) error {
+	req := &ipc.AskLogs{
+		Names: ctx.Args(),
+		Lines: ctx.Int("lines"),
+	}
+
+	if ctx.String("since") != "" {
+		since, err := parseSince(ctx.String("since"))
+		if err != nil {
+			return cli.NewExitError(err.Error(), -1)
+		}
+		req.Since = since.UTC().Unix()
+	}
+
+	for {
+		res, err := GorpcDispatcherClient.Call("logs", req)
+		if err != nil {
+			return err
+		}
+
+		resIpc := res.(*ipc.AnswerLogs)
+		if resIpc.Err {
+			fmt.Printf("Error getting logs: %s\n", resIpc.ErrStr)
+			return errors.New(resIpc.ErrStr)
+		}
+
+		for _, line := range resIpc.Lines {
+			at := time.Unix(0, line.Time).Format("2006/01/02 15:04:05")
+			if len(req.Names) == 1 {
+				fmt.Printf("%s %s\n", at, line.Text)
+			} else {
+				fmt.Printf("%s %s: %s\n", at, line.Service, line.Text)
+			}
+		}
+
+		if !ctx.Bool("follow") {
+			return nil
+		}
+
+		// Only the new lines from now on
+		req.After = resIpc.After
+		req.Lines = 0
+		time.Sleep(followInterval)
+	}
+}
+
+// parseSince accepts a local date, with or without time, or a duration ago
+func parseSince(since string) (time.Time, error) {
+	if d, err := time.ParseDuration(since); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, since, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	if t, err := time.Parse(time.RFC3339, since); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid --since '%s'", since)
+}
@@ -36,6 +36,8 @@ func main() {
 		CmdVersion,
 		CmdStats,
 		CmdStatus,
+		CmdListTimers,
+		CmdLogs,
 		CmdReboot,
 		CmdShutdown,
 		CmdReload,
@@ -53,6 +55,8 @@ func main() {
 	gorpc.RegisterType(&ipc.AnswerReload{})
 	gorpc.RegisterType(&ipc.ServiceAction{})
 	gorpc.RegisterType(&ipc.ServiceActionAnswer{})
+	gorpc.RegisterType(&ipc.AskLogs{})
+	gorpc.RegisterType(&ipc.AnswerLogs{})
 
 	GorpcDispatcher = gorpc.NewDispatcher()
 
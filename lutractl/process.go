@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"github.com/urfave/cli"
+	"strings"
 )
 
 // CmdStart CLI object
@@ -20,18 +21,22 @@ var CmdStart = cli.Command{
 var CmdStop = cli.Command{
 	Name:        "stop",
 	Usage:       "Stop process",
-	Description: "Stop process",
+	Description: "Stop process, after the ones requiring it",
 	Action:      doStop,
-	Flags:       []cli.Flag{},
+	Flags: []cli.Flag{
+		cli.BoolFlag{Name: "no-deps", Usage: "Leave running the processes requiring it"},
+	},
 }
 
 // CmdRestart CLI obkect
 var CmdRestart = cli.Command{
 	Name:        "restart",
 	Usage:       "Restart process",
-	Description: "Restart process",
+	Description: "Restart process, and the ones requiring it",
 	Action:      doRestart,
-	Flags:       []cli.Flag{},
+	Flags: []cli.Flag{
+		cli.BoolFlag{Name: "no-deps", Usage: "Leave running the processes requiring it"},
+	},
 }
 
 func doStart(ctx *cli.Context) error {
@@ -73,13 +78,14 @@ func doStop(ctx *cli.Context) error {
 
 	procName := ctx.Args().First()
 
-	res, err := GorpcDispatcherClient.Call("stop", &ipc.ServiceAction{Name: procName, Action: ipc.Stop})
+	res, err := GorpcDispatcherClient.Call("stop", &ipc.ServiceAction{Name: procName, Action: ipc.Stop, NoDeps: ctx.Bool("no-deps")})
 	if err != nil {
 		return err
 	}
 
 	resIpc := res.(*ipc.ServiceActionAnswer)
 
+	printDeps("Stopped", resIpc.Deps)
 	if resIpc.Err {
 		fmt.Printf("Error stopping %s: %s\n", resIpc.Name, resIpc.ErrStr)
 		return errors.New(resIpc.ErrStr)
@@ -91,13 +97,37 @@ func doStop(ctx *cli.Context) error {
 }
 
 func doRestart(ctx *cli.Context) error {
-	err := doStop(ctx)
-	if err != nil {
-		return err
+	if !IsRoot() {
+		return errors.New("only root can do that")
 	}
-	err = doStart(ctx)
+
+	if !ctx.Args().Present() {
+		return cli.NewExitError("process name required", -1)
+	}
+
+	procName := ctx.Args().First()
+
+	res, err := GorpcDispatcherClient.Call("restart", &ipc.ServiceAction{Name: procName, Action: ipc.Restart, NoDeps: ctx.Bool("no-deps")})
 	if err != nil {
 		return err
 	}
+
+	resIpc := res.(*ipc.ServiceActionAnswer)
+
+	printDeps("Restarting", resIpc.Deps)
+	if resIpc.Err {
+		fmt.Printf("Error restarting %s: %s\n", resIpc.Name, resIpc.ErrStr)
+		return errors.New(resIpc.ErrStr)
+	}
+
+	fmt.Printf("Service %s restarted.\n", resIpc.Name)
+
 	return nil
 }
+
+// printDeps prints the services stopped or restarted along
+func printDeps(what string, deps []string) {
+	if len(deps) > 0 {
+		fmt.Printf("%s %s, depending on it.\n", what, strings.Join(deps, ", "))
+	}
+}
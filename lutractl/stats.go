@@ -1,9 +1,13 @@
 package main
 
 import (
+	"dev.sigpipe.me/dashie/lutrainit/lutrainit/tools"
 	"dev.sigpipe.me/dashie/lutrainit/shared/ipc"
 	"fmt"
 	"github.com/urfave/cli"
+	"os"
+	"text/tabwriter"
+	"time"
 )
 
 // CmdStats CLI object
@@ -54,5 +58,17 @@ func getStats(ctx *cli.Context) error {
 	fmt.Printf("Last GC Pause: %s\n", resIpc.PauseNs)
 	fmt.Printf("GC Times: %d\n", resIpc.NumGC)
 
+	if len(resIpc.Services) > 0 {
+		fmt.Printf("\nServices resources:\n")
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "SERVICE\tMEMORY\tCPU\tTASKS\tIO READ\tIO WRITTEN")
+		for _, u := range resIpc.Services {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\n", u.Name, tools.FileSize(int64(u.Memory)),
+				time.Duration(u.CPUTime).Round(time.Millisecond), u.Tasks,
+				tools.FileSize(int64(u.IOReadBytes)), tools.FileSize(int64(u.IOWriteBytes)))
+		}
+		w.Flush()
+	}
+
 	return err
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"dev.sigpipe.me/dashie/lutrainit/lutrainit/tools"
 	"dev.sigpipe.me/dashie/lutrainit/shared/ipc"
 	"fmt"
 	"github.com/urfave/cli"
@@ -50,12 +51,59 @@ func getStatus(ctx *cli.Context) error {
 			fmt.Printf("WARNING: This service init have been deleted from configuration directory.\n")
 		}
 		fmt.Printf("Status: %s\n", loadedService.State.String())
-		if loadedService.Type == "simple" && loadedService.State == ipc.Started && loadedService.LastKnownPID >= 2 {
+		if loadedService.IsSupervised() && loadedService.State == ipc.Started && loadedService.LastKnownPID >= 2 {
 			fmt.Printf("Lask known PID: %d\n", loadedService.LastKnownPID)
 		}
+		for _, l := range loadedService.Listen {
+			fmt.Printf("Listen: %s\n", l)
+		}
+		for _, d := range loadedService.Devices {
+			fmt.Printf("Device: %s\n", d)
+		}
+		for _, w := range loadedService.Watches {
+			fmt.Printf("Watches: %s\n", w)
+		}
+		if loadedService.Triggers != "" {
+			fmt.Printf("Triggers: %s\n", loadedService.Triggers)
+		}
+		if loadedService.LastTrigger > 0 {
+			fmt.Printf("Last trigger: %s\n", time.Unix(loadedService.LastTrigger, 0).Format(time.RFC1123Z))
+		}
+		if loadedService.NextElapse > 0 {
+			fmt.Printf("Next elapse: %s\n", time.Unix(loadedService.NextElapse, 0).Format(time.RFC1123Z))
+		}
+		if loadedService.Accept {
+			fmt.Printf("Connections: %d\n", loadedService.Connections)
+		}
+		if loadedService.User != "" {
+			fmt.Printf("Runs as: %s, group %s\n", loadedService.User, loadedService.Group)
+		} else if loadedService.CredentialErr != "" {
+			fmt.Printf("Runs as: %s\n", loadedService.CredentialErr)
+		}
+		if loadedService.CapabilityBoundingSet != "" {
+			fmt.Printf("Capability bounding set: %s\n", loadedService.CapabilityBoundingSet)
+		}
+		if u := loadedService.Usage; u != nil {
+			fmt.Printf("Resources: CPU %s, memory %s, %d tasks, IO read %s, written %s\n",
+				time.Duration(u.CPUTime).Round(time.Millisecond), tools.FileSize(int64(u.Memory)), u.Tasks,
+				tools.FileSize(int64(u.IOReadBytes)), tools.FileSize(int64(u.IOWriteBytes)))
+		}
+		if loadedService.Restart != "" && loadedService.Restart != "no" {
+			fmt.Printf("Restart: %s, restarted %d times\n", loadedService.Restart, loadedService.RestartCount)
+		}
+		if loadedService.KilledBy != "" {
+			fmt.Printf("Killed by: %s\n", loadedService.KilledBy)
+		}
 		lastActionAt := time.Unix(loadedService.LastActionAt, 0).Format(time.RFC1123Z)
 		fmt.Printf("Last action: %s at %s\n", loadedService.LastAction.String(), lastActionAt)
-		fmt.Printf("Last message: %s\n\n", loadedService.LastMessage)
+		fmt.Printf("Last message: %s\n", loadedService.LastMessage)
+		if len(loadedService.LogTail) > 0 {
+			fmt.Println("Last output:")
+			for _, line := range loadedService.LogTail {
+				fmt.Printf("  %s\n", line)
+			}
+		}
+		fmt.Println()
 	}
 
 	return err
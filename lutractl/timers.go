@@ -0,0 +1,71 @@
+package main
+
+import (
+	"dev.sigpipe.me/dashie/lutrainit/shared/ipc"
+	"fmt"
+	"github.com/urfave/cli"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// CmdListTimers CLI object
+var CmdListTimers = cli.Command{
+	Name:        "list-timers",
+	Usage:       "Lists the timers, the next to elapse first",
+	Description: "Lists the timers with their last trigger and next elapse, the next to elapse first",
+	Action:      listTimers,
+	Flags:       []cli.Flag{},
+}
+
+func listTimers(ctx *cli.Context) error {
+	res, err := GorpcDispatcherClient.Call("status", &ipc.AskStatus{All: true})
+	if err != nil {
+		fmt.Printf("Cannot get the timers: %s\n", err.Error())
+		return err
+	}
+
+	var timers []*ipc.Service
+	for _, s := range res.(map[ipc.ServiceName]*ipc.Service) {
+		if s.Type == "timer" {
+			timers = append(timers, s)
+		}
+	}
+	if len(timers) == 0 {
+		fmt.Printf("No timers.\n")
+		return nil
+	}
+
+	// The ones which won't elapse go last
+	sort.Slice(timers, func(i, j int) bool {
+		a, b := timers[i].NextElapse, timers[j].NextElapse
+		if (a == 0) != (b == 0) {
+			return b == 0
+		}
+		if a != b {
+			return a < b
+		}
+		return timers[i].Name < timers[j].Name
+	})
+
+	now := time.Now()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NEXT\tLEFT\tLAST\tPASSED\tTIMER\tTRIGGERS")
+	for _, t := range timers {
+		next, left := "n/a", "n/a"
+		if t.NextElapse > 0 {
+			at := time.Unix(t.NextElapse, 0)
+			next = at.Format("Mon 2006-01-02 15:04:05")
+			left = at.Sub(now).Round(time.Second).String()
+		}
+		last, passed := "n/a", "n/a"
+		if t.LastTrigger > 0 {
+			at := time.Unix(t.LastTrigger, 0)
+			last = at.Format("Mon 2006-01-02 15:04:05")
+			passed = now.Sub(at).Round(time.Second).String() + " ago"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", next, left, last, passed, t.Name, t.Triggers)
+	}
+	return w.Flush()
+}
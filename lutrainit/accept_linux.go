@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"github.com/go-clog/clog"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
+)
+
+// acceptedConnections numbers the instances of the templates, named foo@<n>.service
+var acceptedConnections uint64
+
+// acceptConnection accepts a connection on the listening fd of the socket unit name, and runs
+// an instance of its template service with the connection as stdin and stdout. The accept is done
+// right away, epoll would report the fd again, the instance is started by a goroutine.
+func acceptConnection(name ServiceName, w *socketWatch, fd int) {
+	nfd, sa, err := syscall.Accept4(fd, syscall.SOCK_CLOEXEC)
+	if err != nil {
+		if err != syscall.EINTR && err != syscall.EAGAIN && err != syscall.ECONNABORTED {
+			clog.Error(2, "[lutra] Cannot accept a connection on %s: %s", name, err.Error())
+		}
+		return
+	}
+	conn := os.NewFile(uintptr(nfd), fmt.Sprintf("connection of %s", name))
+
+	LoadedServicesMu.RLock()
+	sock := *LoadedServices[name]
+	tmpl, ok := LoadedServices[sock.SocketService]
+	var inst Service
+	if ok {
+		inst = *tmpl
+	}
+	LoadedServicesMu.RUnlock()
+	if !ok || sock.State != Started || ShuttingDown {
+		conn.Close()
+		return
+	}
+
+	addr, port := remoteAddr(sa)
+	if !w.admit(addr, sock.MaxConnections, sock.MaxConnectionsPerSource) {
+		clog.Warn("[lutra] Refusing connection from %s on %s: too many connections", remoteName(addr), name)
+		conn.Close()
+		return
+	}
+
+	n := atomic.AddUint64(&acceptedConnections, 1)
+	inst.Instance = ServiceName(fmt.Sprintf("%s@%d.service", strings.TrimSuffix(string(inst.Name), "@.service"), n))
+	go func() {
+		runInstance(inst, name, conn, addr, port)
+		w.release(addr)
+	}()
+}
+
+// runInstance runs the instance inst of a template for the connection conn accepted on the socket
+// unit name, and waits for it. Its cgroup is removed with what is left in it once it exited.
+func runInstance(inst Service, name ServiceName, conn *os.File, addr string, port int) {
+	defer removeCgroup(inst.Instance)
+	defer inst.removePrivateTmp()
+
+	cmd, err := inst.command(inst.ExecStart)
+	if err != nil {
+		conn.Close()
+		clog.Error(2, "[lutra] Cannot start %s: %s", inst.Instance, err.Error())
+		return
+	}
+	cmd.Stdin = conn
+	cmd.Stdout = conn
+	if addr != "" {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("REMOTE_ADDR=%s", addr), fmt.Sprintf("REMOTE_PORT=%d", port))
+	}
+
+	child, err := startChild(cmd)
+	// The instance has its own copy
+	conn.Close()
+	if err != nil {
+		clog.Error(2, "[lutra] Cannot start %s: %s", inst.Instance, err.Error())
+		return
+	}
+	clog.Trace("[lutra] Connection from %s on %s served by %s, PID %d", remoteName(addr), name, inst.Instance, cmd.Process.Pid)
+
+	if err := child.Wait(); err != nil {
+		clog.Warn("[lutra] %s for %s finished with error: %s", inst.Instance, remoteName(addr), err.Error())
+	}
+}
+
+// admit counts a new connection from addr if the limits allow it, empty addresses (unix
+// sockets) only count in the total
+func (w *socketWatch) admit(addr string, max, maxPerSource int) bool {
+	socketWatchesMu.Lock()
+	defer socketWatchesMu.Unlock()
+	if w.connections >= max {
+		return false
+	}
+	if addr != "" && maxPerSource > 0 && w.sources[addr] >= maxPerSource {
+		return false
+	}
+	w.connections++
+	if addr != "" {
+		w.sources[addr]++
+	}
+	return true
+}
+
+// release a connection counted by admit
+func (w *socketWatch) release(addr string) {
+	socketWatchesMu.Lock()
+	defer socketWatchesMu.Unlock()
+	w.connections--
+	if addr == "" {
+		return
+	}
+	if w.sources[addr]--; w.sources[addr] <= 0 {
+		delete(w.sources, addr)
+	}
+}
+
+// remoteAddr returns the IP address and port of an accepted connection, empty for unix sockets
+func remoteAddr(sa syscall.Sockaddr) (string, int) {
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4:
+		return net.IP(sa.Addr[:]).String(), sa.Port
+	case *syscall.SockaddrInet6:
+		// IPv4 clients of a dual stack socket show up as IPv4
+		return net.IP(sa.Addr[:]).String(), sa.Port
+	}
+	return "", 0
+}
+
+func remoteName(addr string) string {
+	if addr == "" {
+		return "a unix socket"
+	}
+	return addr
+}
+
+// socketConnections returns the number of connections served by the instances of an Accept socket unit
+func socketConnections(name ServiceName) int {
+	socketWatchesMu.Lock()
+	defer socketWatchesMu.Unlock()
+	if w, ok := socketWatches[name]; ok {
+		return w.connections
+	}
+	return 0
+}
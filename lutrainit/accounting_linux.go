@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"dev.sigpipe.me/dashie/lutrainit/shared/ipc"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// clockTicks is USER_HZ, the unit of the CPU times in /proc/<pid>/stat
+const clockTicks = 100
+
+// serviceUsage returns what the processes of the service use, nil if it has none.
+// The cgroup of the service counts everything, even the exited children, else we sum
+// what its main process and its descendants use.
+func serviceUsage(s *Service) *ipc.ServiceUsage {
+	usage := &ipc.ServiceUsage{Name: ipc.ServiceName(s.Name)}
+
+	pids, err := cgroupProcs(s.Name)
+	if err == nil {
+		usage.FromCgroup = true
+	} else if pid := trackedPID(s); processRunning(pid) {
+		pids = append([]int{pid}, processDescendants(pid)...)
+	}
+	if len(pids) == 0 {
+		return nil
+	}
+
+	for _, pid := range pids {
+		addProcUsage(usage, pid)
+	}
+
+	if usage.FromCgroup {
+		addCgroupUsage(usage, cgroupPath(s.Name))
+	}
+
+	return usage
+}
+
+// addProcUsage adds the usage of the process pid from /proc
+func addProcUsage(usage *ipc.ServiceUsage, pid int) {
+	dir := fmt.Sprintf("/proc/%d", pid)
+
+	if stat, err := ioutil.ReadFile(filepath.Join(dir, "stat")); err == nil {
+		// The command name may contain spaces, fields are after its closing parenthesis
+		if i := bytes.LastIndexByte(stat, ')'); i >= 0 {
+			fields := strings.Fields(string(stat[i+1:]))
+			if len(fields) > 17 {
+				// utime, stime, and cutime, cstime of its exited children
+				var ticks int64
+				for _, f := range fields[11:15] {
+					t, _ := strconv.ParseInt(f, 10, 64)
+					ticks += t
+				}
+				usage.CPUTime += ticks * int64(time.Second) / clockTicks
+				threads, _ := strconv.Atoi(fields[17])
+				usage.Tasks += threads
+			}
+		}
+	}
+
+	if kb, ok := readKeyValue(filepath.Join(dir, "status"), "VmRSS:"); ok {
+		usage.Memory += kb * 1024
+	}
+	if rd, ok := readKeyValue(filepath.Join(dir, "io"), "read_bytes:"); ok {
+		usage.IOReadBytes += rd
+	}
+	if wr, ok := readKeyValue(filepath.Join(dir, "io"), "write_bytes:"); ok {
+		usage.IOWriteBytes += wr
+	}
+}
+
+// addCgroupUsage replaces the sums of the processes by the counters of the cgroup, when its controllers are enabled
+func addCgroupUsage(usage *ipc.ServiceUsage, dir string) {
+	if usec, ok := readKeyValue(filepath.Join(dir, "cpu.stat"), "usage_usec"); ok {
+		usage.CPUTime = int64(usec) * int64(time.Microsecond)
+	}
+	if mem, ok := readCgroupValue(dir, "memory.current"); ok {
+		usage.Memory = mem
+	}
+	if tasks, ok := readCgroupValue(dir, "pids.current"); ok {
+		usage.Tasks = int(tasks)
+	}
+
+	// One line per device: "8:0 rbytes=1 wbytes=2 rios=3 wios=4 ..."
+	content, err := ioutil.ReadFile(filepath.Join(dir, "io.stat"))
+	if err != nil {
+		return
+	}
+	var rd, wr uint64
+	for _, field := range strings.Fields(string(content)) {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		v, _ := strconv.ParseUint(kv[1], 10, 64)
+		switch kv[0] {
+		case "rbytes":
+			rd += v
+		case "wbytes":
+			wr += v
+		}
+	}
+	usage.IOReadBytes = rd
+	usage.IOWriteBytes = wr
+}
+
+func readCgroupValue(dir, file string) (uint64, bool) {
+	content, err := ioutil.ReadFile(filepath.Join(dir, file))
+	if err != nil {
+		return 0, false
+	}
+	v, err := strconv.ParseUint(strings.TrimSpace(string(content)), 10, 64)
+	return v, err == nil
+}
+
+// readKeyValue returns the number after key in a "key value [unit]" file like /proc/<pid>/status
+func readKeyValue(path, key string) (uint64, bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == key {
+			v, err := strconv.ParseUint(fields[1], 10, 64)
+			return v, err == nil
+		}
+	}
+	return 0, false
+}
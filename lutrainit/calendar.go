@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// calendar is a parsed OnCalendar: "[weekdays] [[year-]month-day] [hour:minute[:second]]", in
+// local time. Each field is a comma separated list of values, a..b ranges, and /step repetitions.
+type calendar struct {
+	weekdays uint8 // 1<<time.Weekday, 0 for any
+	year     calendarField
+	month    calendarField
+	day      calendarField
+	hour     calendarField
+	minute   calendarField
+	second   calendarField
+}
+
+// calendarField matches any value when nil
+type calendarField []calendarRange
+
+type calendarRange struct {
+	from, to, step int
+}
+
+// calendarShortcuts are the named OnCalendar
+var calendarShortcuts = map[string]string{
+	"minutely":     "*-*-* *:*:00",
+	"hourly":       "*-*-* *:00:00",
+	"daily":        "*-*-* 00:00:00",
+	"weekly":       "Mon *-*-* 00:00:00",
+	"monthly":      "*-*-01 00:00:00",
+	"quarterly":    "*-01,04,07,10-01 00:00:00",
+	"yearly":       "*-01-01 00:00:00",
+	"annually":     "*-01-01 00:00:00",
+	"semiannually": "*-01,07-01 00:00:00",
+}
+
+var weekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// parseCalendar parses an OnCalendar like "Mon..Fri 22:30", "Mon-Fri 22:30", "*-*-01 04:00" or "daily"
+func parseCalendar(spec string) (c calendar, err error) {
+	spec = strings.TrimSpace(spec)
+	if full, ok := calendarShortcuts[strings.ToLower(spec)]; ok {
+		spec = full
+	}
+
+	date, clock := "*-*-*", "00:00:00"
+	for i, part := range strings.Fields(spec) {
+		switch {
+		case i == 0 && unicode.IsLetter(rune(part[0])):
+			if c.weekdays, err = parseWeekdays(part); err != nil {
+				return c, err
+			}
+		case strings.Contains(part, ":"):
+			clock = part
+		case strings.Contains(part, "-"):
+			date = part
+		default:
+			return c, fmt.Errorf("invalid calendar %s", spec)
+		}
+	}
+
+	dateParts := strings.Split(date, "-")
+	if len(dateParts) == 2 {
+		dateParts = append([]string{"*"}, dateParts...)
+	}
+	clockParts := strings.Split(clock, ":")
+	if len(clockParts) == 2 {
+		clockParts = append(clockParts, "00")
+	}
+	if len(dateParts) != 3 || len(clockParts) != 3 {
+		return c, fmt.Errorf("invalid calendar %s", spec)
+	}
+
+	fields := []struct {
+		field    *calendarField
+		val      string
+		min, max int
+	}{
+		{&c.year, dateParts[0], 1970, 2199},
+		{&c.month, dateParts[1], 1, 12},
+		{&c.day, dateParts[2], 1, 31},
+		{&c.hour, clockParts[0], 0, 23},
+		{&c.minute, clockParts[1], 0, 59},
+		{&c.second, clockParts[2], 0, 59},
+	}
+	for _, f := range fields {
+		if *f.field, err = parseCalendarField(f.val, f.min, f.max); err != nil {
+			return c, fmt.Errorf("invalid calendar %s: %s", spec, err.Error())
+		}
+	}
+	return c, nil
+}
+
+// parseWeekdays parses "Mon,Wed", "Mon..Fri" or "Mon-Fri", full names are accepted
+func parseWeekdays(val string) (uint8, error) {
+	day := func(name string) (int, error) {
+		name = strings.ToLower(name)
+		for n, known := range weekdayNames {
+			if len(name) >= 3 && strings.HasPrefix(name, known) {
+				return n, nil
+			}
+		}
+		return 0, fmt.Errorf("unknown weekday %s", name)
+	}
+
+	var mask uint8
+	for _, item := range strings.Split(val, ",") {
+		bounds := strings.SplitN(item, "..", 2)
+		if len(bounds) == 1 {
+			bounds = strings.SplitN(item, "-", 2)
+		}
+		from, err := day(bounds[0])
+		if err != nil {
+			return 0, err
+		}
+		to := from
+		if len(bounds) == 2 {
+			if to, err = day(bounds[1]); err != nil {
+				return 0, err
+			}
+		}
+		// Sat..Mon wraps through Sunday
+		for d := from; ; d = (d + 1) % 7 {
+			mask |= 1 << uint(d)
+			if d == to {
+				break
+			}
+		}
+	}
+	return mask, nil
+}
+
+// parseCalendarField parses "*", "5", "1,15", "8..18", "*/15" or "0..30/10"
+func parseCalendarField(val string, min, max int) (calendarField, error) {
+	if val == "*" {
+		return nil, nil
+	}
+
+	var field calendarField
+	for _, item := range strings.Split(val, ",") {
+		r := calendarRange{from: min, to: max, step: 1}
+
+		if parts := strings.SplitN(item, "/", 2); len(parts) == 2 {
+			step, err := strconv.Atoi(parts[1])
+			if err != nil || step < 1 {
+				return nil, fmt.Errorf("invalid repetition %s", item)
+			}
+			r.step = step
+			item = parts[0]
+		}
+
+		if item != "*" {
+			bounds := strings.SplitN(item, "..", 2)
+			from, err := strconv.Atoi(bounds[0])
+			if err != nil {
+				return nil, fmt.Errorf("invalid value %s", item)
+			}
+			r.from = from
+			// A single value with a repetition goes up to the max
+			if r.step == 1 {
+				r.to = from
+			}
+			if len(bounds) == 2 {
+				if r.to, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, fmt.Errorf("invalid value %s", item)
+				}
+			}
+		}
+
+		if r.from < min || r.to > max || r.from > r.to {
+			return nil, fmt.Errorf("%s is out of %d..%d", item, min, max)
+		}
+		field = append(field, r)
+	}
+	return field, nil
+}
+
+func (f calendarField) match(v int) bool {
+	if f == nil {
+		return true
+	}
+	for _, r := range f {
+		if v >= r.from && v <= r.to && (v-r.from)%r.step == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// next returns the first time strictly after after matching c, zero if there is none soon
+func (c calendar) next(after time.Time) time.Time {
+	loc := after.Location()
+	t := after.Truncate(time.Second).Add(time.Second)
+	limit := after.Year() + 10
+
+	// Each mismatch jumps to the start of the next year, month, day, hour or minute
+	for t.Year() <= limit {
+		y, m, d := t.Date()
+		var jump time.Time
+		switch {
+		case !c.year.match(y):
+			jump = time.Date(y+1, 1, 1, 0, 0, 0, 0, loc)
+		case !c.month.match(int(m)):
+			jump = time.Date(y, m+1, 1, 0, 0, 0, 0, loc)
+		case !c.day.match(d) || (c.weekdays != 0 && c.weekdays&(1<<uint(t.Weekday())) == 0):
+			jump = time.Date(y, m, d+1, 0, 0, 0, 0, loc)
+		case !c.hour.match(t.Hour()):
+			jump = time.Date(y, m, d, t.Hour()+1, 0, 0, 0, loc)
+		case !c.minute.match(t.Minute()):
+			jump = time.Date(y, m, d, t.Hour(), t.Minute()+1, 0, 0, loc)
+		case !c.second.match(t.Second()):
+			jump = t.Add(time.Second)
+		default:
+			return t
+		}
+		// An hour repeated by a DST change could send us back
+		if !jump.After(t) {
+			jump = t.Add(time.Second)
+		}
+		t = jump
+	}
+	return time.Time{}
+}
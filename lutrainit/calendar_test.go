@@ -0,0 +1,148 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCalendar(t *testing.T) {
+	tests := []struct {
+		spec     string
+		weekdays uint8
+	}{
+		{"daily", 0},
+		{"Weekly", 1 << time.Monday},
+		{"*-*-01 04:00", 0},
+		{"*:0/15", 0},
+		{"2024-02-29 12:00:30", 0},
+		{"Mon..Fri 22:30", 0x3e},
+		{"Mon-Fri 22:30", 0x3e},
+		{"monday-friday", 0x3e},
+		{"Sat..Mon", 1<<time.Saturday | 1<<time.Sunday | 1<<time.Monday},
+		{"Sat-Mon *-*-* 08:00", 1<<time.Saturday | 1<<time.Sunday | 1<<time.Monday},
+		{"Sat,Sun 10:00", 1<<time.Saturday | 1<<time.Sunday},
+		{"Mon,Wed..Thu", 1<<time.Monday | 1<<time.Wednesday | 1<<time.Thursday},
+		{"Fri *-*-13", 1 << time.Friday},
+		{"*-01,04,07,10-01", 0},
+		{"8..18/2:00", 0},
+	}
+	for _, test := range tests {
+		c, err := parseCalendar(test.spec)
+		if err != nil {
+			t.Errorf("%q: %s", test.spec, err.Error())
+			continue
+		}
+		if c.weekdays != test.weekdays {
+			t.Errorf("%q: got weekdays %07b, want %07b", test.spec, c.weekdays, test.weekdays)
+		}
+	}
+
+	for _, spec := range []string{"foo", "Mon..Fry", "Mon-", "12:00 Mon", "25:00", "12:60", "*-13-01", "*-*-32",
+		"*-*-00", "1969-01-01", "*:0/0", "*:10..5", "1-2-3-4", "1:2:3:4", "Mon 12:00 13:00 x"} {
+		if _, err := parseCalendar(spec); err == nil {
+			t.Errorf("%q: no error", spec)
+		}
+	}
+}
+
+func TestCalendarNext(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Skip("no time zone data: ", err.Error())
+	}
+	at := func(s string) time.Time {
+		tm, err := time.ParseInLocation("2006-01-02 15:04:05", s, paris)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+
+	tests := []struct {
+		spec, after, want string
+	}{
+		{"daily", "2024-06-07 23:00:00", "2024-06-08 00:00:00"},
+		{"daily", "2024-06-08 00:00:00", "2024-06-09 00:00:00"},
+		{"hourly", "2024-06-07 23:59:59", "2024-06-08 00:00:00"},
+		{"*:0/15", "2024-06-07 10:07:00", "2024-06-07 10:15:00"},
+		{"*:0/15", "2024-06-07 10:45:00", "2024-06-07 11:00:00"},
+		{"monthly", "2024-12-15 00:00:00", "2025-01-01 00:00:00"},
+		{"8..18/2:00", "2024-06-07 18:00:00", "2024-06-08 08:00:00"},
+
+		// Only the months which have them
+		{"*-*-31", "2024-04-01 00:00:00", "2024-05-31 00:00:00"},
+		{"*-*-31", "2024-05-31 00:00:00", "2024-07-31 00:00:00"},
+		{"*-*-31 12:00", "2024-01-31 12:00:00", "2024-03-31 12:00:00"},
+		{"*-02-29 12:00", "2024-01-01 00:00:00", "2024-02-29 12:00:00"},
+		{"*-02-29 12:00", "2024-02-29 12:00:00", "2028-02-29 12:00:00"},
+		{"*-02-29", "2025-01-01 00:00:00", "2028-02-29 00:00:00"},
+		{"2100-02-29", "2024-01-01 00:00:00", ""},
+		{"2020-01-01", "2024-01-01 00:00:00", ""},
+
+		// 2024-06-07 is a Friday
+		{"Mon..Fri 22:30", "2024-06-07 22:29:59", "2024-06-07 22:30:00"},
+		{"Mon..Fri 22:30", "2024-06-07 22:30:00", "2024-06-10 22:30:00"},
+		{"Mon-Fri 22:30", "2024-06-08 12:00:00", "2024-06-10 22:30:00"},
+		{"Sat..Mon 08:00", "2024-06-04 08:00:00", "2024-06-08 08:00:00"},
+		{"Sat..Mon 08:00", "2024-06-09 08:00:00", "2024-06-10 08:00:00"},
+		{"Sat..Mon 08:00", "2024-06-10 08:00:00", "2024-06-15 08:00:00"},
+		{"weekly", "2024-06-07 12:00:00", "2024-06-10 00:00:00"},
+		{"Fri *-*-13", "2024-01-01 00:00:00", "2024-09-13 00:00:00"},
+		{"Sun *-02-29", "2024-01-01 00:00:00", "2032-02-29 00:00:00"},
+
+		// 02:00 CET is 03:00 CEST on 2024-03-31, the skipped times don't elapse that day
+		{"*-*-* 02:30", "2024-03-30 12:00:00", "2024-04-01 02:30:00"},
+		{"*-*-* 03:00", "2024-03-31 01:00:00", "2024-03-31 03:00:00"},
+		{"hourly", "2024-03-31 01:00:00", "2024-03-31 03:00:00"},
+		{"daily", "2024-03-30 12:00:00", "2024-03-31 00:00:00"},
+		{"daily", "2024-03-31 00:00:00", "2024-04-01 00:00:00"},
+	}
+	for _, test := range tests {
+		c, err := parseCalendar(test.spec)
+		if err != nil {
+			t.Errorf("%q: %s", test.spec, err.Error())
+			continue
+		}
+		got := c.next(at(test.after))
+		if test.want == "" {
+			if !got.IsZero() {
+				t.Errorf("%q after %s: got %s, want none", test.spec, test.after, got)
+			}
+			continue
+		}
+		if want := at(test.want); !got.Equal(want) {
+			t.Errorf("%q after %s: got %s, want %s", test.spec, test.after, got, want)
+		}
+	}
+}
+
+// 03:00 CEST is 02:00 CET on 2024-10-27, the repeated times elapse once
+func TestCalendarNextRepeatedHour(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Skip("no time zone data: ", err.Error())
+	}
+
+	c, err := parseCalendar("*-*-* 02:30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := c.next(time.Date(2024, 10, 27, 0, 0, 0, 0, paris))
+	if h, m, _ := first.Clock(); first.Day() != 27 || h != 2 || m != 30 {
+		t.Fatalf("got %s, want 2024-10-27 02:30", first)
+	}
+	second := c.next(first)
+	if want := time.Date(2024, 10, 28, 2, 30, 0, 0, paris); !second.Equal(want) {
+		t.Errorf("after %s: got %s, want %s", first, second, want)
+	}
+
+	// Even the ones of hourly
+	c, _ = parseCalendar("hourly")
+	var hours []int
+	for tm := time.Date(2024, 10, 27, 1, 0, 0, 0, paris); tm.Day() == 27 && tm.Hour() < 5; tm = c.next(tm) {
+		hours = append(hours, tm.Hour())
+	}
+	if len(hours) != 4 || hours[0] != 1 || hours[1] != 2 || hours[2] != 3 || hours[3] != 4 {
+		t.Errorf("got hours %v, want [1 2 3 4]", hours)
+	}
+}
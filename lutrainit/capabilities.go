@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Capabilities of the processes of a service, as masks of 1<<CAP_*
+type Capabilities struct {
+	CapabilityBoundingSet *uint64 // nil keeps the one of lutrainit
+	AmbientCapabilities   uint64  // kept by the command even as an unprivileged User
+	NoNewPrivileges       bool
+}
+
+// IsSet if anything must be changed
+func (c Capabilities) IsSet() bool {
+	return c.CapabilityBoundingSet != nil || c.AmbientCapabilities != 0 || c.NoNewPrivileges
+}
+
+// capabilityNames are the CAP_* numbers of linux/capability.h
+var capabilityNames = []string{
+	"CAP_CHOWN",
+	"CAP_DAC_OVERRIDE",
+	"CAP_DAC_READ_SEARCH",
+	"CAP_FOWNER",
+	"CAP_FSETID",
+	"CAP_KILL",
+	"CAP_SETGID",
+	"CAP_SETUID",
+	"CAP_SETPCAP",
+	"CAP_LINUX_IMMUTABLE",
+	"CAP_NET_BIND_SERVICE",
+	"CAP_NET_BROADCAST",
+	"CAP_NET_ADMIN",
+	"CAP_NET_RAW",
+	"CAP_IPC_LOCK",
+	"CAP_IPC_OWNER",
+	"CAP_SYS_MODULE",
+	"CAP_SYS_RAWIO",
+	"CAP_SYS_CHROOT",
+	"CAP_SYS_PTRACE",
+	"CAP_SYS_PACCT",
+	"CAP_SYS_ADMIN",
+	"CAP_SYS_BOOT",
+	"CAP_SYS_NICE",
+	"CAP_SYS_RESOURCE",
+	"CAP_SYS_TIME",
+	"CAP_SYS_TTY_CONFIG",
+	"CAP_MKNOD",
+	"CAP_LEASE",
+	"CAP_AUDIT_WRITE",
+	"CAP_AUDIT_CONTROL",
+	"CAP_SETFCAP",
+	"CAP_MAC_OVERRIDE",
+	"CAP_MAC_ADMIN",
+	"CAP_SYSLOG",
+	"CAP_WAKE_ALARM",
+	"CAP_BLOCK_SUSPEND",
+	"CAP_AUDIT_READ",
+	"CAP_PERFMON",
+	"CAP_BPF",
+	"CAP_CHECKPOINT_RESTORE",
+}
+
+// allCapabilities is the mask of all the known capabilities
+var allCapabilities = uint64(1)<<uint(len(capabilityNames)) - 1
+
+// parseCapabilities parses space or comma separated names like CAP_NET_BIND_SERVICE, in any case.
+// With a "~" prefix, the mask has all the capabilities but the listed ones.
+func parseCapabilities(list string) (uint64, error) {
+	invert := strings.HasPrefix(list, "~")
+	list = strings.TrimPrefix(list, "~")
+
+	var mask uint64
+	for _, name := range strings.FieldsFunc(list, func(r rune) bool { return r == ',' || r == ' ' }) {
+		n := capabilityNumber(name)
+		if n < 0 {
+			return 0, fmt.Errorf("unknown capability %s", name)
+		}
+		mask |= 1 << uint(n)
+	}
+
+	if invert {
+		return allCapabilities &^ mask, nil
+	}
+	return mask, nil
+}
+
+// capabilityNumber returns the CAP_* number of name, with or without its CAP_ prefix, -1 if unknown
+func capabilityNumber(name string) int {
+	name = strings.ToUpper(name)
+	if !strings.HasPrefix(name, "CAP_") {
+		name = "CAP_" + name
+	}
+	for n, known := range capabilityNames {
+		if known == name {
+			return n
+		}
+	}
+	return -1
+}
+
+// capabilityList returns the names of the capabilities of mask
+func capabilityList(mask uint64) []string {
+	var names []string
+	for n, name := range capabilityNames {
+		if mask&(1<<uint(n)) != 0 {
+			names = append(names, name)
+		}
+	}
+	return names
+}
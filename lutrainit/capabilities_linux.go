@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	prSetKeepCaps   = 8
+	prCapBSetDrop   = 24
+	prSetNoNewPrivs = 38
+	prCapAmbient    = 47
+
+	prCapAmbientRaise = 2
+
+	linuxCapabilityVersion3 = 0x20080522
+)
+
+type capHeader struct {
+	version uint32
+	pid     int32
+}
+
+type capData struct {
+	effective   uint32
+	permitted   uint32
+	inheritable uint32
+}
+
+func prctl(option, arg2 uintptr) error {
+	if _, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, option, arg2, 0, 0, 0, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// limit drops the bounding set, it needs CAP_SETPCAP so it is done before the credentials.
+// The permitted capabilities are kept through the user change for the ambient ones.
+func (c Capabilities) limit() error {
+	if c.CapabilityBoundingSet != nil {
+		for n := 0; n <= capLastCap(); n++ {
+			if *c.CapabilityBoundingSet&(1<<uint(n)) != 0 {
+				continue
+			}
+			if err := prctl(prCapBSetDrop, uintptr(n)); err != nil {
+				return fmt.Errorf("cannot drop %s from the bounding set: %s", capabilityName(n), err.Error())
+			}
+		}
+	}
+
+	if c.AmbientCapabilities != 0 {
+		if err := prctl(prSetKeepCaps, 1); err != nil {
+			return fmt.Errorf("cannot keep capabilities: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// raise the ambient capabilities once the credentials are dropped, they survive the exec of the
+// command. Then nothing may gain privileges anymore with NoNewPrivileges.
+func (c Capabilities) raise() error {
+	if c.AmbientCapabilities != 0 {
+		// Ambient ones must be permitted, kept by limit, and inheritable
+		header := capHeader{version: linuxCapabilityVersion3}
+		var data [2]capData
+		if _, _, errno := syscall.RawSyscall(syscall.SYS_CAPGET, uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+			return fmt.Errorf("cannot get capabilities: %s", errno.Error())
+		}
+		data[0].inheritable |= uint32(c.AmbientCapabilities)
+		data[1].inheritable |= uint32(c.AmbientCapabilities >> 32)
+		if _, _, errno := syscall.RawSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+			return fmt.Errorf("cannot set inheritable capabilities: %s", errno.Error())
+		}
+
+		for n := range capabilityNames {
+			if c.AmbientCapabilities&(1<<uint(n)) == 0 {
+				continue
+			}
+			if _, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, prCapAmbient, prCapAmbientRaise, uintptr(n), 0, 0, 0); errno != 0 {
+				return fmt.Errorf("cannot raise ambient %s: %s", capabilityName(n), errno.Error())
+			}
+		}
+	}
+
+	if c.NoNewPrivileges {
+		if err := prctl(prSetNoNewPrivs, 1); err != nil {
+			return fmt.Errorf("cannot set NoNewPrivileges: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// capLastCap is the last capability known by the kernel
+func capLastCap() int {
+	content, err := ioutil.ReadFile("/proc/sys/kernel/cap_last_cap")
+	if err != nil {
+		return len(capabilityNames) - 1
+	}
+	last, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil {
+		return len(capabilityNames) - 1
+	}
+	return last
+}
+
+// capabilityName returns CAP_NET_RAW for 13, the number of the ones newer than us
+func capabilityName(n int) string {
+	if n < len(capabilityNames) {
+		return capabilityNames[n]
+	}
+	return strconv.Itoa(n)
+}
+
+// boundingSet returns the effective capability bounding set of the service: the one of its
+// main process when it runs, else what it will get from lutrainit and its CapabilityBoundingSet.
+// It is "all", "none", or the names of the capabilities.
+func boundingSet(s *Service) string {
+	mask, ok := uint64(0), false
+	if pid := trackedPID(s); processRunning(pid) {
+		mask, ok = readCapBnd(fmt.Sprintf("/proc/%d/status", pid))
+	}
+	if !ok {
+		if mask, ok = readCapBnd("/proc/self/status"); !ok {
+			return ""
+		}
+		if s.CapabilityBoundingSet != nil {
+			mask &= *s.CapabilityBoundingSet
+		}
+	}
+
+	switch mask &= allCapabilities; mask {
+	case allCapabilities:
+		return "all"
+	case 0:
+		return "none"
+	}
+	return strings.Join(capabilityList(mask), " ")
+}
+
+// readCapBnd returns the CapBnd mask of a /proc/<pid>/status file
+func readCapBnd(path string) (uint64, bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "CapBnd:" {
+			mask, err := strconv.ParseUint(fields[1], 16, 64)
+			return mask, err == nil
+		}
+	}
+	return 0, false
+}
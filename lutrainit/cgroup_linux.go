@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"github.com/go-clog/clog"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	cgroupRoot  = "/sys/fs/cgroup"
+	cgroupSlice = "lutra.slice"
+
+	// cgroup2SuperMagic is the f_type of a cgroup v2 filesystem
+	cgroup2SuperMagic = 0x63677270
+
+	// cgroupControllers are enabled for the services when the kernel has them
+	cgroupControllers = "cpu io memory pids"
+)
+
+var (
+	// cgroupsEnabled once lutra.slice is ready, services run without cgroup else
+	cgroupsEnabled = false
+
+	// cgroupDirs are opened once per service, to start its processes directly in it
+	cgroupDirs   = make(map[ServiceName]*os.File)
+	cgroupDirsMu = sync.Mutex{}
+)
+
+// setupCgroups mounts the cgroup v2 hierarchy if needed and creates the lutra.slice of the services
+func setupCgroups() {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(cgroupRoot, &st); err != nil || st.Type != cgroup2SuperMagic {
+		if err == nil && st.Type != cgroup2SuperMagic && isMountpoint(cgroupRoot) {
+			// cgroup v1 or hybrid, set up by someone else
+			clog.Warn("[lutra] %s is not a cgroup v2 hierarchy, services won't have cgroups", cgroupRoot)
+			return
+		}
+		Mount("cgroup2", "cgroup2", cgroupRoot, "nsdelegate")
+		if err := syscall.Statfs(cgroupRoot, &st); err != nil || st.Type != cgroup2SuperMagic {
+			clog.Warn("[lutra] Cannot mount cgroup v2 hierarchy, services won't have cgroups")
+			return
+		}
+	}
+
+	slice := filepath.Join(cgroupRoot, cgroupSlice)
+	if err := os.MkdirAll(slice, 0755); err != nil {
+		clog.Error(2, "[lutra] Cannot create %s: %s", slice, err.Error())
+		return
+	}
+
+	// Controllers must be enabled from the root down to the services
+	available, err := ioutil.ReadFile(filepath.Join(cgroupRoot, "cgroup.controllers"))
+	if err != nil {
+		clog.Error(2, "[lutra] Cannot read cgroup controllers: %s", err.Error())
+		return
+	}
+	var enable []string
+	for _, c := range strings.Fields(string(available)) {
+		if strings.Contains(" "+cgroupControllers+" ", " "+c+" ") {
+			enable = append(enable, "+"+c)
+		}
+	}
+	for _, dir := range []string{cgroupRoot, slice} {
+		if err := writeCgroupFile(dir, "cgroup.subtree_control", strings.Join(enable, " ")); err != nil {
+			clog.Warn("[lutra] Cannot enable cgroup controllers in %s: %s", dir, err.Error())
+		}
+	}
+
+	cgroupsEnabled = true
+	clog.Info("[lutra] Services cgroups in %s, controllers: %s", slice, strings.Join(enable, " "))
+}
+
+// isMountpoint tells if dir is on another device than its parent
+func isMountpoint(dir string) bool {
+	var st, parent syscall.Stat_t
+	if syscall.Stat(dir, &st) != nil || syscall.Stat(filepath.Dir(dir), &parent) != nil {
+		return false
+	}
+	return st.Dev != parent.Dev
+}
+
+func writeCgroupFile(dir, file, value string) error {
+	return ioutil.WriteFile(filepath.Join(dir, file), []byte(value), 0644)
+}
+
+// cgroupPath of the service
+func cgroupPath(name ServiceName) string {
+	return filepath.Join(cgroupRoot, cgroupSlice, string(name))
+}
+
+// cgroupName of the service, an instance of a template has its own
+func (s Service) cgroupName() ServiceName {
+	if s.Instance != "" {
+		return s.Instance
+	}
+	return s.Name
+}
+
+// setupCgroup creates the cgroup of the service and applies its limits, which are reset when unset
+func (s Service) setupCgroup() error {
+	dir := cgroupPath(s.cgroupName())
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	limits := []struct {
+		file, value, unset string
+	}{
+		{"memory.max", s.MemoryMax, "max"},
+		{"cpu.weight", intOrEmpty(s.CPUWeight), "100"},
+		{"cpu.max", cpuMax(s.CPUQuota), "max 100000"},
+		{"pids.max", s.TasksMax, "max"},
+		{"io.weight", ioWeight(s.IOWeight), "default 100"},
+	}
+	for _, l := range limits {
+		if l.value == "" {
+			// The controller may not be there, nothing to reset then
+			writeCgroupFile(dir, l.file, l.unset)
+			continue
+		}
+		if err := writeCgroupFile(dir, l.file, l.value); err != nil {
+			return fmt.Errorf("cannot set %s to %s: %s", l.file, l.value, err.Error())
+		}
+	}
+
+	return nil
+}
+
+func intOrEmpty(v int) string {
+	if v == 0 {
+		return ""
+	}
+	return strconv.Itoa(v)
+}
+
+// cpuMax converts a CPUQuota percentage, over a 100ms period
+func cpuMax(quota int) string {
+	if quota == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d 100000", quota*1000)
+}
+
+func ioWeight(weight int) string {
+	if weight == 0 {
+		return ""
+	}
+	return fmt.Sprintf("default %d", weight)
+}
+
+// joinCgroup makes cmd start directly in the cgroup of the service, so even its first fork is in it
+func (s Service) joinCgroup(cmd *exec.Cmd) error {
+	if !cgroupsEnabled {
+		return nil
+	}
+
+	if err := s.setupCgroup(); err != nil {
+		return fmt.Errorf("cannot set up cgroup of %s: %s", s.Name, err.Error())
+	}
+
+	cgroupDirsMu.Lock()
+	defer cgroupDirsMu.Unlock()
+
+	name := s.cgroupName()
+	dir, ok := cgroupDirs[name]
+	if !ok {
+		var err error
+		if dir, err = os.Open(cgroupPath(name)); err != nil {
+			return err
+		}
+		cgroupDirs[name] = dir
+	}
+
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(dir.Fd())
+	return nil
+}
+
+// cgroupProcs returns all the processes in the cgroup of the service
+func cgroupProcs(name ServiceName) ([]int, error) {
+	if !cgroupsEnabled {
+		return nil, fmt.Errorf("cgroups not enabled")
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(cgroupPath(name), "cgroup.procs"))
+	if err != nil {
+		return nil, err
+	}
+
+	var pids []int
+	for _, line := range strings.Fields(string(content)) {
+		if pid, err := strconv.Atoi(line); err == nil {
+			pids = append(pids, pid)
+		}
+	}
+	return pids, nil
+}
+
+// removeCgroup kills what is left in the cgroup name and removes it, for the instances of
+// templates which have one per connection
+func removeCgroup(name ServiceName) {
+	if !cgroupsEnabled {
+		return
+	}
+
+	cgroupDirsMu.Lock()
+	if dir, ok := cgroupDirs[name]; ok {
+		dir.Close()
+		delete(cgroupDirs, name)
+	}
+	cgroupDirsMu.Unlock()
+
+	// The directory can only go once the killed processes are reaped
+	for tries := 0; ; tries++ {
+		pids, err := cgroupProcs(name)
+		if err != nil {
+			return
+		}
+		for _, pid := range pids {
+			syscall.Kill(pid, syscall.SIGKILL)
+		}
+		err = os.Remove(cgroupPath(name))
+		if err == nil || os.IsNotExist(err) {
+			return
+		}
+		if tries == 100 {
+			clog.Warn("[lutra] Cannot remove cgroup of %s: %s", name, err.Error())
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -6,6 +6,9 @@ import (
 	"github.com/go-clog/clog"
 	"github.com/go-ini/ini"
 	"io/ioutil"
+	"math"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -24,8 +27,17 @@ var (
 			MaxLines  int64
 			MaxDays   int64
 			BufferLen int64
+
+			ServicesDir string
+			TailLines   int64
 		}
 
+		// Default setrlimit limits of the services
+		Rlimits []Rlimit
+
+		// KEY=VAL given to all services
+		Environment []string
+
 		StartedReexec bool
 	}
 )
@@ -48,10 +60,11 @@ func ParseConfig(baseDir string, fname string) (Service, error) {
 	}
 
 	if !ipc.IsCustASCII(fname) {
-		return s, fmt.Errorf("%s has invalid service name '%s', only a-Z0-9_-. allowed", fname, s.Name)
+		return s, fmt.Errorf("%s has invalid service name '%s', only a-Z0-9_-.@ allowed", fname, s.Name)
 	}
 
-	Cfg, err := ini.InsensitiveLoad(fmt.Sprintf("%s/lutra.d/%s", baseDir, fname))
+	// Environment can be repeated
+	Cfg, err := ini.LoadSources(ini.LoadOptions{Insensitive: true, AllowShadows: true}, fmt.Sprintf("%s/lutra.d/%s", baseDir, fname))
 	if err != nil {
 		clog.Error(2, "Failed to parse '%s': %v", fname, err)
 		return s, err
@@ -65,12 +78,52 @@ func ParseConfig(baseDir string, fname string) (Service, error) {
 	}
 
 	s.Requires = sec.Key("Requires").Strings(",")
+	s.Wants = sec.Key("Wants").Strings(",")
+	s.BindsTo = sec.Key("BindsTo").Strings(",")
+	s.PartOf = sec.Key("PartOf").Strings(",")
+	s.Conflicts = sec.Key("Conflicts").Strings(",")
 	s.Before = sec.Key("Before").Strings(",")
 	s.After = sec.Key("After").Strings(",")
-	if strings.HasSuffix(string(s.Name), ".target") {
-		s.WantedBy = sec.Key("WantedBy").MustString("")
+	// Before Key(), which creates it
+	if sec.HasKey("WantedBy") {
+		s.WantedBy = sec.Key("WantedBy").Strings(",")
 	} else {
-		s.WantedBy = sec.Key("WantedBy").MustString("multi-user.target")
+		if s.IsSocket() {
+			// Listening early, the services they start don't need to be ordered after them
+			s.WantedBy = []string{"basic.target"}
+		} else if !s.IsTarget() {
+			s.WantedBy = []string{"multi-user.target"}
+		}
+	}
+
+	// Services only, the units starting them have their own triggers
+	s.BindsToDevice = sec.Key("BindsToDevice").MustString("")
+	if s.BindsToDevice != "" {
+		if _, err := pathDeviceMatch(s.BindsToDevice); err != nil || !s.IsService() {
+			clog.Error(2, "service %s invalid BindsToDevice: %s", fname, s.BindsToDevice)
+			return s, fmt.Errorf("service %s invalid BindsToDevice: %s", fname, s.BindsToDevice)
+		}
+	}
+	for _, spec := range sec.Key("WantedByDevice").ValueWithShadows() {
+		if spec == "" {
+			continue
+		}
+		m, err := parseDeviceMatch(spec)
+		if err != nil || !s.IsService() {
+			clog.Error(2, "service %s invalid WantedByDevice: %s", fname, spec)
+			return s, fmt.Errorf("service %s invalid WantedByDevice: %s", fname, spec)
+		}
+		s.WantedByDevice = append(s.WantedByDevice, m)
+	}
+
+	if s.IsSocket() {
+		return parseSocketUnit(s, Cfg, fname)
+	}
+	if s.IsTimer() {
+		return parseTimerUnit(s, Cfg, fname)
+	}
+	if s.IsPath() {
+		return parsePathUnit(s, Cfg, fname)
 	}
 
 	sec, err = Cfg.GetSection("service")
@@ -91,11 +144,133 @@ func ParseConfig(baseDir string, fname string) (Service, error) {
 	s.AutoStart = sec.Key("Autostart").MustBool(false)
 
 	s.Type = sec.Key("Type").MustString("forking")
-	if s.Type != "forking" && s.Type != "simple" && s.Type != "oneshot" && s.Type != "virtual" {
+	if s.Type != "forking" && s.Type != "simple" && s.Type != "notify" && s.Type != "oneshot" && s.Type != "virtual" {
 		clog.Error(2, "service %s invalid type: %s", fname, s.Type)
 		return s, fmt.Errorf("service %s invalid type: %s", fname, s.Type)
 	}
 
+	s.Restart = sec.Key("Restart").MustString(RestartNo)
+	if s.Restart != RestartNo && s.Restart != RestartOnFailure && s.Restart != RestartOnAbnormal && s.Restart != RestartAlways {
+		clog.Error(2, "service %s invalid restart policy: %s", fname, s.Restart)
+		return s, fmt.Errorf("service %s invalid restart policy: %s", fname, s.Restart)
+	}
+	s.RestartSec = mustSeconds(sec.Key("RestartSec"), time.Second)
+	s.StartLimitBurst = sec.Key("StartLimitBurst").MustInt(5)
+	s.StartLimitInterval = mustSeconds(sec.Key("StartLimitIntervalSec"), 10*time.Second)
+
+	s.TimeoutStart = mustSeconds(sec.Key("TimeoutStartSec"), 90*time.Second)
+	s.TimeoutStop = mustSeconds(sec.Key("TimeoutStopSec"), 30*time.Second)
+	s.KillSignal, err = parseSignal(sec.Key("KillSignal").MustString("SIGTERM"))
+	if err != nil {
+		clog.Error(2, "service %s invalid KillSignal: %s", fname, err.Error())
+		return s, fmt.Errorf("service %s invalid KillSignal: %s", fname, err.Error())
+	}
+	s.KillMode = sec.Key("KillMode").MustString(KillControlGroup)
+	if s.KillMode != KillProcess && s.KillMode != KillProcessGroup && s.KillMode != KillControlGroup {
+		clog.Error(2, "service %s invalid KillMode: %s", fname, s.KillMode)
+		return s, fmt.Errorf("service %s invalid KillMode: %s", fname, s.KillMode)
+	}
+
+	s.User = sec.Key("User").MustString("")
+	s.Group = sec.Key("Group").MustString("")
+	s.SupplementaryGroups = sec.Key("SupplementaryGroups").Strings(",")
+	s.WorkingDirectory = sec.Key("WorkingDirectory").MustString("")
+	if s.WorkingDirectory != "" && s.WorkingDirectory != "~" && !filepath.IsAbs(s.WorkingDirectory) {
+		clog.Error(2, "service %s WorkingDirectory must be absolute or ~: %s", fname, s.WorkingDirectory)
+		return s, fmt.Errorf("service %s WorkingDirectory must be absolute or ~: %s", fname, s.WorkingDirectory)
+	}
+	s.UMask = sec.Key("UMask").MustString("")
+	if umask, err := strconv.ParseUint(s.UMask, 8, 32); s.UMask != "" && (err != nil || umask > 0777) {
+		clog.Error(2, "service %s invalid UMask: %s", fname, s.UMask)
+		return s, fmt.Errorf("service %s invalid UMask: %s", fname, s.UMask)
+	}
+
+	for _, kv := range sec.Key("Environment").ValueWithShadows() {
+		if kv == "" {
+			continue
+		}
+		if err = checkEnvironment(kv); err != nil {
+			clog.Error(2, "service %s invalid Environment: %s", fname, err.Error())
+			return s, fmt.Errorf("service %s invalid Environment: %s", fname, err.Error())
+		}
+		s.Environment = append(s.Environment, kv)
+	}
+	for _, path := range sec.Key("EnvironmentFile").ValueWithShadows() {
+		if path == "" {
+			continue
+		}
+		if !filepath.IsAbs(strings.TrimPrefix(path, "-")) {
+			clog.Error(2, "service %s EnvironmentFile must be absolute: %s", fname, path)
+			return s, fmt.Errorf("service %s EnvironmentFile must be absolute: %s", fname, path)
+		}
+		s.EnvironmentFiles = append(s.EnvironmentFiles, path)
+	}
+
+	if s.Rlimits, err = parseRlimits(sec); err != nil {
+		clog.Error(2, "service %s invalid limit: %s", fname, err.Error())
+		return s, fmt.Errorf("service %s invalid limit: %s", fname, err.Error())
+	}
+
+	if s.Scheduling, err = parseScheduling(sec); err != nil {
+		clog.Error(2, "service %s invalid scheduling: %s", fname, err.Error())
+		return s, fmt.Errorf("service %s invalid scheduling: %s", fname, err.Error())
+	}
+
+	if s.Sandbox, err = parseSandbox(sec); err != nil {
+		clog.Error(2, "service %s invalid sandboxing: %s", fname, err.Error())
+		return s, fmt.Errorf("service %s invalid sandboxing: %s", fname, err.Error())
+	}
+	if s.Capabilities, err = parseCapabilitiesSettings(sec); err != nil {
+		clog.Error(2, "service %s invalid capabilities: %s", fname, err.Error())
+		return s, fmt.Errorf("service %s invalid capabilities: %s", fname, err.Error())
+	}
+
+	s.Seccomp, err = parseSeccomp(sec.Key("SystemCallFilter").ValueWithShadows(), sec.Key("SystemCallErrorNumber").MustString(""))
+	if err != nil {
+		clog.Error(2, "service %s invalid SystemCallFilter: %s", fname, err.Error())
+		return s, fmt.Errorf("service %s invalid SystemCallFilter: %s", fname, err.Error())
+	}
+
+	// The namespace dies with its PID 1, which a forking service leaves
+	if s.PrivatePID && s.Type == "forking" {
+		clog.Error(2, "service %s cannot be forking with PrivatePID", fname)
+		return s, fmt.Errorf("service %s cannot be forking with PrivatePID", fname)
+	}
+
+	// Resources limits of its cgroup
+	if s.MemoryMax, err = parseLimit(sec.Key("MemoryMax").MustString(""), true); err != nil {
+		clog.Error(2, "service %s invalid MemoryMax: %s", fname, err.Error())
+		return s, fmt.Errorf("service %s invalid MemoryMax: %s", fname, err.Error())
+	}
+	if s.TasksMax, err = parseLimit(sec.Key("TasksMax").MustString(""), false); err != nil {
+		clog.Error(2, "service %s invalid TasksMax: %s", fname, err.Error())
+		return s, fmt.Errorf("service %s invalid TasksMax: %s", fname, err.Error())
+	}
+	s.CPUWeight = sec.Key("CPUWeight").MustInt(0)
+	s.IOWeight = sec.Key("IOWeight").MustInt(0)
+	if s.CPUWeight < 0 || s.CPUWeight > 10000 || s.IOWeight < 0 || s.IOWeight > 10000 {
+		clog.Error(2, "service %s CPUWeight and IOWeight must be between 1 and 10000", fname)
+		return s, fmt.Errorf("service %s CPUWeight and IOWeight must be between 1 and 10000", fname)
+	}
+	quota := strings.TrimSuffix(sec.Key("CPUQuota").MustString(""), "%")
+	if quota != "" {
+		if s.CPUQuota, err = strconv.Atoi(quota); err != nil || s.CPUQuota < 1 {
+			clog.Error(2, "service %s invalid CPUQuota: %s%%", fname, quota)
+			return s, fmt.Errorf("service %s invalid CPUQuota: %s%%", fname, quota)
+		}
+	}
+
+	s.StandardOutput = sec.Key("StandardOutput").MustString(OutputLog)
+	if err = checkOutput(s.StandardOutput); err != nil {
+		clog.Error(2, "service %s invalid StandardOutput: %s", fname, err.Error())
+		return s, fmt.Errorf("service %s invalid StandardOutput: %s", fname, err.Error())
+	}
+	s.StandardError = sec.Key("StandardError").MustString(s.StandardOutput)
+	if err = checkOutput(s.StandardError); err != nil {
+		clog.Error(2, "service %s invalid StandardError: %s", fname, err.Error())
+		return s, fmt.Errorf("service %s invalid StandardError: %s", fname, err.Error())
+	}
+
 	// some sanity check
 	// Must have an ExecStart, execept if it's a virtual service
 	if s.Type != "virtual" && s.ExecStart == "" {
@@ -107,9 +282,146 @@ func ParseConfig(baseDir string, fname string) (Service, error) {
 		clog.Warn("service %s does not have a PIDFile, considers setting it", fname)
 	}
 
+	// we only supervise simple and notify services
+	if !s.IsSupervised() && s.Restart != RestartNo {
+		clog.Warn("service %s has a Restart policy but only simple and notify services are restarted", fname)
+	}
+
 	return s, err
 }
 
+// mustSeconds parses a time span given in seconds ("5", "0.5") or as a Go duration ("500ms", "1m30s").
+// It returns defaultVal when the key is not set or invalid.
+func mustSeconds(k *ini.Key, defaultVal time.Duration) time.Duration {
+	val := strings.TrimSpace(k.String())
+	if val == "" {
+		return defaultVal
+	}
+
+	if secs, err := strconv.ParseFloat(val, 64); err == nil {
+		return time.Duration(secs * float64(time.Second))
+	}
+	if d, err := time.ParseDuration(val); err == nil {
+		return d
+	}
+
+	clog.Warn("invalid time span '%s' for %s, using %s", val, k.Name(), defaultVal)
+	return defaultVal
+}
+
+// parseRlimits parses the Limit* keys of sec, LimitNOFILE=1024:4096
+func parseRlimits(sec *ini.Section) (limits []Rlimit, err error) {
+	for name, resource := range rlimitResources {
+		val := sec.Key("Limit" + name).MustString("")
+		if val == "" {
+			continue
+		}
+		l, err := parseRlimit(resource, val)
+		if err != nil {
+			return nil, fmt.Errorf("Limit%s: %s", name, err.Error())
+		}
+		limits = append(limits, l)
+	}
+	return limits, nil
+}
+
+// parseScheduling parses Nice, OOMScoreAdjust, IOScheduling* CPUScheduling* and CPUAffinity
+func parseScheduling(sec *ini.Section) (sc Scheduling, err error) {
+	if sc.Nice, err = optionalInt(sec.Key("Nice").MustString("")); err != nil {
+		return sc, fmt.Errorf("Nice: %s", err.Error())
+	}
+	if sc.OOMScoreAdjust, err = optionalInt(sec.Key("OOMScoreAdjust").MustString("")); err != nil {
+		return sc, fmt.Errorf("OOMScoreAdjust: %s", err.Error())
+	}
+	sc.IOSchedulingClass = sec.Key("IOSchedulingClass").MustString("")
+	sc.IOSchedulingPriority = sec.Key("IOSchedulingPriority").MustInt(4)
+	sc.CPUSchedulingPolicy = sec.Key("CPUSchedulingPolicy").MustString("")
+	sc.CPUSchedulingPriority = sec.Key("CPUSchedulingPriority").MustInt(0)
+	if sc.CPUAffinity, err = parseCPUList(sec.Key("CPUAffinity").MustString("")); err != nil {
+		return sc, fmt.Errorf("CPUAffinity: %s", err.Error())
+	}
+
+	return sc, sc.check()
+}
+
+// parseSandbox parses the Private* namespaces, Protect* and the *Paths lists, which are space separated
+func parseSandbox(sec *ini.Section) (sb Sandbox, err error) {
+	sb.PrivateNetwork = sec.Key("PrivateNetwork").MustBool(false)
+	sb.PrivateIPC = sec.Key("PrivateIPC").MustBool(false)
+	sb.PrivateUTS = sec.Key("PrivateUTS").MustBool(false)
+	sb.PrivatePID = sec.Key("PrivatePID").MustBool(false)
+	sb.PrivateTmp = sec.Key("PrivateTmp").MustBool(false)
+	if sb.ProtectSystem, err = protectSetting(sec.Key("ProtectSystem").MustString(""), "full", "strict"); err != nil {
+		return sb, fmt.Errorf("ProtectSystem: %s", err.Error())
+	}
+	if sb.ProtectHome, err = protectSetting(sec.Key("ProtectHome").MustString(""), "read-only", "tmpfs"); err != nil {
+		return sb, fmt.Errorf("ProtectHome: %s", err.Error())
+	}
+
+	paths := func(key string) (list []string) {
+		for _, val := range sec.Key(key).ValueWithShadows() {
+			list = append(list, strings.Fields(val)...)
+		}
+		return list
+	}
+	sb.ReadOnlyPaths = paths("ReadOnlyPaths")
+	sb.ReadWritePaths = paths("ReadWritePaths")
+	sb.InaccessiblePaths = paths("InaccessiblePaths")
+	sb.BindPaths = paths("BindPaths")
+
+	return sb, sb.check()
+}
+
+// parseCapabilitiesSettings parses CapabilityBoundingSet, AmbientCapabilities and NoNewPrivileges
+func parseCapabilitiesSettings(sec *ini.Section) (c Capabilities, err error) {
+	if bounding := sec.Key("CapabilityBoundingSet").MustString(""); bounding != "" {
+		mask, err := parseCapabilities(bounding)
+		if err != nil {
+			return c, fmt.Errorf("CapabilityBoundingSet: %s", err.Error())
+		}
+		c.CapabilityBoundingSet = &mask
+	}
+	if c.AmbientCapabilities, err = parseCapabilities(sec.Key("AmbientCapabilities").MustString("")); err != nil {
+		return c, fmt.Errorf("AmbientCapabilities: %s", err.Error())
+	}
+	c.NoNewPrivileges = sec.Key("NoNewPrivileges").MustBool(false)
+
+	if c.CapabilityBoundingSet != nil && c.AmbientCapabilities&^*c.CapabilityBoundingSet != 0 {
+		return c, fmt.Errorf("AmbientCapabilities %s are not in the CapabilityBoundingSet",
+			strings.Join(capabilityList(c.AmbientCapabilities&^*c.CapabilityBoundingSet), " "))
+	}
+	return c, nil
+}
+
+// parseLimit accepts a number, infinity, and with withUnits a K, M, G or T suffix (powers of 1024).
+// It returns the value for the cgroup file, "max" for infinity.
+func parseLimit(val string, withUnits bool) (string, error) {
+	val = strings.TrimSpace(val)
+	if val == "" {
+		return "", nil
+	}
+	if val == "infinity" || val == "max" {
+		return "max", nil
+	}
+
+	multiplier := uint64(1)
+	if withUnits {
+		if i := strings.Index("KMGT", strings.ToUpper(val[len(val)-1:])); i >= 0 {
+			multiplier = 1 << (10 * uint(i+1))
+			val = val[:len(val)-1]
+		}
+	}
+
+	n, err := strconv.ParseUint(val, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("%s is not a number", val)
+	}
+	if n > math.MaxUint64/multiplier {
+		return "", fmt.Errorf("%s is too large", val)
+	}
+	return strconv.FormatUint(n*multiplier, 10), nil
+}
+
 // ParseServiceConfigs parse all the config in directory dir return a map of
 // providers of ServiceTypes from that directory.
 func ParseServiceConfigs(baseDir string, reloading bool) error {
@@ -125,9 +437,12 @@ func ParseServiceConfigs(baseDir string, reloading bool) error {
 			continue
 		}
 
-		// We only want to parse files ending with .service
+		// We only want to parse files ending with .service, .target, .socket, .timer or .path
 		if !strings.HasSuffix(fstat.Name(), ".service") &&
-			!strings.HasSuffix(fstat.Name(), ".target") {
+			!strings.HasSuffix(fstat.Name(), ".target") &&
+			!strings.HasSuffix(fstat.Name(), ".socket") &&
+			!strings.HasSuffix(fstat.Name(), ".timer") &&
+			!strings.HasSuffix(fstat.Name(), ".path") {
 			continue
 		}
 
@@ -137,8 +452,8 @@ func ParseServiceConfigs(baseDir string, reloading bool) error {
 			continue
 		}
 
-		// If we are not reloading, set initial state and actions
-		if !reloading {
+		// If we are not reloading, or for a new file, set initial state and actions
+		if _, loaded := LoadedServices[s.Name]; !reloading || !loaded {
 			s.State = NotStarted
 			s.LastAction = Unknown
 			s.LastActionAt = time.Now().UTC().Unix()
@@ -153,13 +468,68 @@ func ParseServiceConfigs(baseDir string, reloading bool) error {
 			LoadedServices[s.Name].AutoStart = s.AutoStart
 			LoadedServices[s.Name].PIDFile = s.PIDFile
 			LoadedServices[s.Name].ExecPreStart = s.ExecPreStart
-			LoadedServices[s.Name].Startup = s.Startup
+			LoadedServices[s.Name].ExecStart = s.ExecStart
 			LoadedServices[s.Name].ExecPostStart = s.ExecPostStart
 			LoadedServices[s.Name].ExecPreStop = s.ExecPreStop
-			LoadedServices[s.Name].Shutdown = s.Shutdown
+			LoadedServices[s.Name].ExecStop = s.ExecStop
 			LoadedServices[s.Name].ExecPostStop = s.ExecPostStop
 			LoadedServices[s.Name].Type = s.Type
 			LoadedServices[s.Name].Requires = s.Requires
+			LoadedServices[s.Name].Wants = s.Wants
+			LoadedServices[s.Name].BindsTo = s.BindsTo
+			LoadedServices[s.Name].PartOf = s.PartOf
+			LoadedServices[s.Name].Conflicts = s.Conflicts
+			LoadedServices[s.Name].Before = s.Before
+			LoadedServices[s.Name].After = s.After
+			LoadedServices[s.Name].WantedBy = s.WantedBy
+			LoadedServices[s.Name].BindsToDevice = s.BindsToDevice
+			LoadedServices[s.Name].WantedByDevice = s.WantedByDevice
+			LoadedServices[s.Name].Restart = s.Restart
+			LoadedServices[s.Name].RestartSec = s.RestartSec
+			LoadedServices[s.Name].StartLimitBurst = s.StartLimitBurst
+			LoadedServices[s.Name].StartLimitInterval = s.StartLimitInterval
+			LoadedServices[s.Name].TimeoutStart = s.TimeoutStart
+			LoadedServices[s.Name].TimeoutStop = s.TimeoutStop
+			LoadedServices[s.Name].KillSignal = s.KillSignal
+			LoadedServices[s.Name].KillMode = s.KillMode
+			LoadedServices[s.Name].User = s.User
+			LoadedServices[s.Name].Group = s.Group
+			LoadedServices[s.Name].SupplementaryGroups = s.SupplementaryGroups
+			LoadedServices[s.Name].WorkingDirectory = s.WorkingDirectory
+			LoadedServices[s.Name].UMask = s.UMask
+			LoadedServices[s.Name].Environment = s.Environment
+			LoadedServices[s.Name].EnvironmentFiles = s.EnvironmentFiles
+			LoadedServices[s.Name].Rlimits = s.Rlimits
+			LoadedServices[s.Name].Scheduling = s.Scheduling
+			LoadedServices[s.Name].Sandbox = s.Sandbox
+			LoadedServices[s.Name].Capabilities = s.Capabilities
+			LoadedServices[s.Name].Seccomp = s.Seccomp
+			LoadedServices[s.Name].Listen = s.Listen
+			LoadedServices[s.Name].SocketService = s.SocketService
+			LoadedServices[s.Name].SocketMode = s.SocketMode
+			LoadedServices[s.Name].FileDescriptorName = s.FileDescriptorName
+			LoadedServices[s.Name].Accept = s.Accept
+			LoadedServices[s.Name].MaxConnections = s.MaxConnections
+			LoadedServices[s.Name].MaxConnectionsPerSource = s.MaxConnectionsPerSource
+			LoadedServices[s.Name].OnCalendar = s.OnCalendar
+			LoadedServices[s.Name].OnBootSec = s.OnBootSec
+			LoadedServices[s.Name].OnUnitActiveSec = s.OnUnitActiveSec
+			LoadedServices[s.Name].RandomizedDelaySec = s.RandomizedDelaySec
+			LoadedServices[s.Name].Persistent = s.Persistent
+			LoadedServices[s.Name].TimerService = s.TimerService
+			// Computed again with the new schedule
+			LoadedServices[s.Name].NextElapse = time.Time{}
+			LoadedServices[s.Name].PathWatches = s.PathWatches
+			LoadedServices[s.Name].PathService = s.PathService
+			LoadedServices[s.Name].MakeDirectory = s.MakeDirectory
+			LoadedServices[s.Name].DirectoryMode = s.DirectoryMode
+			LoadedServices[s.Name].MemoryMax = s.MemoryMax
+			LoadedServices[s.Name].CPUWeight = s.CPUWeight
+			LoadedServices[s.Name].CPUQuota = s.CPUQuota
+			LoadedServices[s.Name].TasksMax = s.TasksMax
+			LoadedServices[s.Name].IOWeight = s.IOWeight
+			LoadedServices[s.Name].StandardOutput = s.StandardOutput
+			LoadedServices[s.Name].StandardError = s.StandardError
 		}
 
 	}
@@ -168,7 +538,8 @@ func ParseServiceConfigs(baseDir string, reloading bool) error {
 
 // ParseSetupConfig parse the main configuration
 func ParseSetupConfig(fname string) (err error) {
-	Cfg, err := ini.InsensitiveLoad(fname)
+	// Names of variables are case sensitive, [environment] is kept raw
+	Cfg, err := ini.LoadSources(ini.LoadOptions{Insensitive: true, UnparseableSections: []string{"environment"}}, fname)
 	if err != nil {
 		clog.Error(2, "Failed to parse '%s': %v", fname, err)
 		return err
@@ -187,6 +558,19 @@ func ParseSetupConfig(fname string) (err error) {
 	MainConfig.Log.MaxSize = sec.Key("max_size_shift").MustInt(28)
 	MainConfig.Log.MaxLines = sec.Key("max_lines").MustInt64(1000000)
 	MainConfig.Log.BufferLen = sec.Key("buffer_len").MustInt64(100)
+	MainConfig.Log.ServicesDir = sec.Key("services_dir").MustString("/var/log/lutrainit")
+	MainConfig.Log.TailLines = sec.Key("tail_lines").MustInt64(1000)
+
+	// Default limits of the services
+	if MainConfig.Rlimits, err = parseRlimits(Cfg.Section("limits")); err != nil {
+		clog.Error(2, "Invalid [limits] in '%s': %s", fname, err.Error())
+		return err
+	}
+
+	if MainConfig.Environment, err = parseEnvironment(Cfg.Section("environment").Body()); err != nil {
+		clog.Error(2, "Invalid [environment] in '%s': %s", fname, err.Error())
+		return err
+	}
 
 	return err
 }
@@ -226,6 +610,7 @@ func ReloadConfig(reloading bool, baseDir string, withFile bool) (err error) {
 	dissappeared := 0
 	for k := range LoadedServices {
 		if LoadedServices[k].Deleted {
+			closeServiceLog(k)
 			dissappeared++
 		}
 	}
@@ -235,31 +620,69 @@ func ReloadConfig(reloading bool, baseDir string, withFile bool) (err error) {
 
 	// TODO: sanity check that targets: basic, disk, network and multi-user are presents
 	for _, s := range LoadedServices {
-		if s.WantedBy != "" {
-			if _, ok := LoadedServices[ServiceName(s.WantedBy)]; !ok {
-				clog.Error(2, "service %s has inexistant WantedBy: %s", s.Name, s.WantedBy)
-				return fmt.Errorf("service %s has inexistant WantedBy: %s", s.Name, s.WantedBy)
+		if s.Deleted {
+			continue
+		}
+
+		if s.IsSocket() {
+			if t, ok := LoadedServices[s.SocketService]; !ok || !t.IsService() {
+				clog.Error(2, "socket %s has inexistant Service: %s", s.Name, s.SocketService)
+				return fmt.Errorf("socket %s has inexistant Service: %s", s.Name, s.SocketService)
+			}
+			if s.Accept != LoadedServices[s.SocketService].IsTemplate() {
+				clog.Error(2, "socket %s needs Accept only and always for a template service: %s", s.Name, s.SocketService)
+				return fmt.Errorf("socket %s needs Accept only and always for a template service: %s", s.Name, s.SocketService)
 			}
 		}
 
-		for _, d := range s.Requires {
-			if _, ok := LoadedServices[ServiceName(d)]; !ok {
-				clog.Error(2, "service %s has inexistant Requires: %s", s.Name, d)
-				return fmt.Errorf("service %s has inexistant Requires: %s", s.Name, d)
+		if s.IsTimer() {
+			if t, ok := LoadedServices[s.TimerService]; !ok || !t.IsService() || t.IsTemplate() {
+				clog.Error(2, "timer %s has inexistant Unit: %s", s.Name, s.TimerService)
+				return fmt.Errorf("timer %s has inexistant Unit: %s", s.Name, s.TimerService)
+			}
+		}
+
+		if s.IsPath() {
+			if t, ok := LoadedServices[s.PathService]; !ok || !t.IsService() || t.IsTemplate() {
+				clog.Error(2, "path %s has inexistant Unit: %s", s.Name, s.PathService)
+				return fmt.Errorf("path %s has inexistant Unit: %s", s.Name, s.PathService)
+			}
+		}
+
+		relations := []struct {
+			kind  string
+			names []string
+		}{
+			{"WantedBy", s.WantedBy},
+			{"Requires", s.Requires},
+			{"Wants", s.Wants},
+			{"BindsTo", s.BindsTo},
+			{"PartOf", s.PartOf},
+			{"Conflicts", s.Conflicts},
+			{"After", s.After},
+			{"Before", s.Before},
+		}
+		for _, rel := range relations {
+			for _, d := range rel.names {
+				if _, ok := LoadedServices[ServiceName(d)]; !ok {
+					clog.Error(2, "service %s has inexistant %s: %s", s.Name, rel.kind, d)
+					return fmt.Errorf("service %s has inexistant %s: %s", s.Name, rel.kind, d)
+				}
 			}
 		}
 
-		for _, d := range s.After {
-			if _, ok := LoadedServices[ServiceName(d)]; !ok {
-				clog.Error(2, "service %s has inexistant After: %s", s.Name, d)
-				return fmt.Errorf("service %s has inexistant After: %s", s.Name, d)
+		for _, t := range s.WantedBy {
+			if !LoadedServices[ServiceName(t)].IsTarget() {
+				clog.Error(2, "service %s has WantedBy %s which is not a target", s.Name, t)
+				return fmt.Errorf("service %s has WantedBy %s which is not a target", s.Name, t)
 			}
 		}
 
-		for _, d := range s.Before {
-			if _, ok := LoadedServices[ServiceName(d)]; !ok {
-				clog.Error(2, "service %s has inexistant Before: %s", s.Name, d)
-				return fmt.Errorf("service %s has inexistant Before: %s", s.Name, d)
+		// Starting it would stop what it needs
+		for _, d := range s.Conflicts {
+			if ServiceName(d) == s.Name || contains(s.Requires, d) || contains(s.Wants, d) || contains(s.BindsTo, d) || contains(s.PartOf, d) {
+				clog.Error(2, "service %s cannot both depend on and conflict with %s", s.Name, d)
+				return fmt.Errorf("service %s cannot both depend on and conflict with %s", s.Name, d)
 			}
 		}
 	}
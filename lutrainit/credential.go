@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// lookupUser accepts a user name or uid
+func lookupUser(name string) (*user.User, error) {
+	if _, err := strconv.Atoi(name); err == nil {
+		return user.LookupId(name)
+	}
+	return user.Lookup(name)
+}
+
+// lookupGroup accepts a group name or gid
+func lookupGroup(name string) (*user.Group, error) {
+	if _, err := strconv.Atoi(name); err == nil {
+		return user.LookupGroupId(name)
+	}
+	return user.LookupGroup(name)
+}
+
+func parseID(id string) (uint32, error) {
+	v, err := strconv.ParseUint(id, 10, 32)
+	return uint32(v), err
+}
+
+// credential resolves the User, Group and SupplementaryGroups of the service, nil if it runs as root.
+// Users are resolved on each start, they may be created after lutrainit parsed the service.
+func (s Service) credential() (*syscall.Credential, error) {
+	if s.User == "" && s.Group == "" && len(s.SupplementaryGroups) == 0 {
+		return nil, nil
+	}
+
+	cred := &syscall.Credential{}
+	var groups []string
+
+	if s.User != "" {
+		u, err := lookupUser(s.User)
+		if err != nil {
+			return nil, fmt.Errorf("unknown User %s: %s", s.User, err.Error())
+		}
+		if cred.Uid, err = parseID(u.Uid); err != nil {
+			return nil, err
+		}
+		if cred.Gid, err = parseID(u.Gid); err != nil {
+			return nil, err
+		}
+		// Like a login, the user gets its own groups
+		if groups, err = u.GroupIds(); err != nil {
+			return nil, fmt.Errorf("cannot get groups of %s: %s", s.User, err.Error())
+		}
+	}
+
+	if s.Group != "" {
+		g, err := lookupGroup(s.Group)
+		if err != nil {
+			return nil, fmt.Errorf("unknown Group %s: %s", s.Group, err.Error())
+		}
+		if cred.Gid, err = parseID(g.Gid); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, name := range s.SupplementaryGroups {
+		g, err := lookupGroup(name)
+		if err != nil {
+			return nil, fmt.Errorf("unknown SupplementaryGroups %s: %s", name, err.Error())
+		}
+		groups = append(groups, g.Gid)
+	}
+
+	for _, gid := range groups {
+		id, err := parseID(gid)
+		if err != nil {
+			return nil, err
+		}
+		cred.Groups = append(cred.Groups, id)
+	}
+
+	return cred, nil
+}
+
+// workingDirectory of the service, ~ is the home of its User
+func (s Service) workingDirectory() (string, error) {
+	if s.WorkingDirectory != "~" {
+		return s.WorkingDirectory, nil
+	}
+
+	name := s.User
+	if name == "" {
+		name = "0"
+	}
+	u, err := lookupUser(name)
+	if err != nil {
+		return "", fmt.Errorf("cannot find home of %s: %s", name, err.Error())
+	}
+	return u.HomeDir, nil
+}
+
+// runAs describes who the processes of the service run as, for lutractl status
+func (s Service) runAs() (runUser string, runGroup string, err error) {
+	cred, err := s.credential()
+	if err != nil || cred == nil {
+		return "", "", err
+	}
+
+	runUser = fmt.Sprintf("%d", cred.Uid)
+	if u, err := user.LookupId(runUser); err == nil {
+		runUser = fmt.Sprintf("%s (%d)", u.Username, cred.Uid)
+	}
+	runGroup = fmt.Sprintf("%d", cred.Gid)
+	if g, err := user.LookupGroupId(runGroup); err == nil {
+		runGroup = fmt.Sprintf("%s (%d)", g.Name, cred.Gid)
+	}
+	return runUser, runGroup, nil
+}
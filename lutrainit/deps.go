@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"github.com/go-clog/clog"
+)
+
+// wantedBy if target is one of its WantedBy
+func (s Service) wantedBy(target ServiceName) bool {
+	return contains(s.WantedBy, string(target))
+}
+
+// orderingDeps are the services it starts after: Requires, Wants, BindsTo and PartOf.
+// Conflicts don't order anything.
+func (s Service) orderingDeps() []string {
+	deps := append([]string{}, s.Requires...)
+	deps = append(deps, s.Wants...)
+	deps = append(deps, s.BindsTo...)
+	return append(deps, s.PartOf...)
+}
+
+// homeTarget is the first of its WantedBy reached at boot, the one it is ordered with,
+// OrderedTargets must be sorted
+func (s Service) homeTarget() ServiceName {
+	for _, t := range OrderedTargets {
+		if s.wantedBy(t) {
+			return t
+		}
+	}
+	if len(s.WantedBy) > 0 {
+		return ServiceName(s.WantedBy[0])
+	}
+	return ""
+}
+
+// conflictsWith if one of s and o has the other in its Conflicts
+func (s Service) conflictsWith(o *Service) bool {
+	return contains(s.Conflicts, string(o.Name)) || contains(o.Conflicts, string(s.Name))
+}
+
+func contains(list []string, val string) bool {
+	for _, v := range list {
+		if v == val {
+			return true
+		}
+	}
+	return false
+}
+
+// runningServices returns the services started or starting matching keep
+func runningServices(keep func(s *Service) bool) []*Service {
+	LoadedServicesMu.RLock()
+	defer LoadedServicesMu.RUnlock()
+
+	var services []*Service
+	for _, s := range LoadedServices {
+		if (s.State == Starting || s.State == Started) && keep(s) {
+			services = append(services, s)
+		}
+	}
+	return services
+}
+
+// stopConflicts stops the running services conflicting with s, before it starts
+func stopConflicts(s *Service) {
+	for _, c := range runningServices(s.conflictsWith) {
+		clog.Info("[lutra] Stopping %s, conflicting with %s", c.Name, s.Name)
+		if err := CheckAndStopService(c); err != nil {
+			clog.Error(2, "[lutra] Cannot stop %s conflicting with %s: %s", c.Name, s.Name, err.Error())
+		}
+	}
+}
+
+// stopParts stops the running services PartOf s, before s is stopped
+func stopParts(s *Service) {
+	parts := runningServices(func(p *Service) bool {
+		return contains(p.PartOf, string(s.Name))
+	})
+	for _, p := range parts {
+		clog.Info("[lutra] Stopping %s, part of %s", p.Name, s.Name)
+		if err := CheckAndStopService(p); err != nil {
+			clog.Error(2, "[lutra] Cannot stop %s part of %s: %s", p.Name, s.Name, err.Error())
+		}
+	}
+}
+
+// stopBoundTo stops the running services with BindsTo name, which just stopped
+func stopBoundTo(name ServiceName) {
+	LoadedServicesMu.RLock()
+	state := LoadedServices[name].State
+	LoadedServicesMu.RUnlock()
+	if state == Starting || state == Started {
+		return // restarted meanwhile, with the ones bound to it
+	}
+
+	bound := runningServices(func(b *Service) bool {
+		return contains(b.BindsTo, string(name))
+	})
+	for _, b := range bound {
+		clog.Info("[lutra] Stopping %s, bound to %s which stopped", b.Name, name)
+		if err := CheckAndStopService(b); err != nil {
+			clog.Error(2, "[lutra] Cannot stop %s bound to %s: %s", b.Name, name, err.Error())
+		}
+	}
+}
+
+// dependsOn if it follows the stops of name: with BindsTo and PartOf, and with Requires too when
+// required
+func (s Service) dependsOn(name ServiceName, required bool) bool {
+	return contains(s.BindsTo, string(name)) || contains(s.PartOf, string(name)) ||
+		(required && contains(s.Requires, string(name)))
+}
+
+// dependents returns the running services depending on s, directly or not, each one before the
+// ones it depends on. Without required, only the ones stopping with s anyway.
+func dependents(s *Service, required bool) []*Service {
+	LoadedServicesMu.RLock()
+	defer LoadedServicesMu.RUnlock()
+
+	var order []*Service
+	seen := map[ServiceName]bool{s.Name: true}
+	var visit func(name ServiceName)
+	visit = func(name ServiceName) {
+		for _, d := range LoadedServices {
+			if seen[d.Name] || (d.State != Starting && d.State != Started) || !d.dependsOn(name, required) {
+				continue
+			}
+			seen[d.Name] = true
+			visit(d.Name)
+			order = append(order, d)
+		}
+	}
+	visit(s.Name)
+	return order
+}
+
+// waitExited waits for the supervisor of s to see its process exit after a stop, else it could
+// mark as stopped the process started next. It gives up after its stop timeouts.
+func waitExited(s *Service) error {
+	if !s.IsSupervised() {
+		return nil
+	}
+	LoadedServicesMu.Lock()
+	defer LoadedServicesMu.Unlock()
+	timeout := s.TimeoutStop + sigkillTimeout
+	if !waitState(func() bool { return s.LastKnownPID == 0 }, timeout) {
+		return fmt.Errorf("%s (PID %d) did not exit after %s", s.Name, s.LastKnownPID, timeout)
+	}
+	return nil
+}
+
+// waitStarted waits for a supervised s to be started, it fails if s didn't start before its
+// start timeouts
+func waitStarted(s *Service) error {
+	if !s.IsSupervised() {
+		return nil
+	}
+	LoadedServicesMu.Lock()
+	defer LoadedServicesMu.Unlock()
+	timeout := s.TimeoutStart + sigkillTimeout
+	if !waitState(func() bool { return s.State != Starting }, timeout) {
+		return fmt.Errorf("%s not started after %s", s.Name, timeout)
+	}
+	if s.State != Started {
+		return fmt.Errorf("%s did not start: %s", s.Name, s.LastMessage)
+	}
+	return nil
+}
+
+// StopService stops the services depending on s, then s. With noDeps, the ones with Requires
+// are left running. It returns the dependents stopped.
+func StopService(s *Service, noDeps bool) ([]*Service, error) {
+	deps := dependents(s, !noDeps)
+	for i, d := range deps {
+		clog.Info("[lutra] Stopping %s, depending on %s", d.Name, s.Name)
+		if err := CheckAndStopService(d); err != nil {
+			clog.Error(2, "[lutra] Cannot stop %s depending on %s: %s", d.Name, s.Name, err.Error())
+			return deps[:i], fmt.Errorf("cannot stop %s depending on it: %s", d.Name, err.Error())
+		}
+		// Before the ones it depends on
+		if err := waitExited(d); err != nil {
+			return deps[:i+1], err
+		}
+	}
+	return deps, CheckAndStopService(s)
+}
+
+// RestartService stops s if it is running, like StopService, then starts it again and the
+// services stopped with it. It returns them.
+func RestartService(s *Service, noDeps bool) ([]*Service, error) {
+	LoadedServicesMu.RLock()
+	running := s.State == Starting || s.State == Started
+	LoadedServicesMu.RUnlock()
+
+	var deps []*Service
+	if running {
+		var err error
+		if deps, err = StopService(s, noDeps); err != nil {
+			return deps, err
+		}
+		if err := waitExited(s); err != nil {
+			return deps, err
+		}
+	}
+	if err := CheckAndStartService(s); err != nil {
+		return deps, err
+	}
+	if err := waitStarted(s); err != nil {
+		return deps, err
+	}
+
+	// The dependencies first, each one started before the next
+	for i := len(deps) - 1; i >= 0; i-- {
+		clog.Info("[lutra] Starting %s again, depending on %s", deps[i].Name, s.Name)
+		err := CheckAndStartService(deps[i])
+		if err == nil {
+			err = waitStarted(deps[i])
+		}
+		if err != nil {
+			return deps, fmt.Errorf("%s restarted, but not %s: %s", s.Name, deps[i].Name, err.Error())
+		}
+	}
+	return deps, nil
+}
+
+// serviceNames of services, for lutractl
+func serviceNames(services []*Service) []string {
+	var names []string
+	for _, s := range services {
+		names = append(names, string(s.Name))
+	}
+	return names
+}
@@ -0,0 +1,107 @@
+package main
+
+import "testing"
+
+func TestHomeTarget(t *testing.T) {
+	defer loadServices([]ServiceName{"basic.target", "multi-user.target", "graphical.target"})()
+
+	tests := []struct {
+		wantedBy []string
+		home     ServiceName
+	}{
+		{nil, ""},
+		{[]string{"multi-user.target"}, "multi-user.target"},
+		{[]string{"graphical.target", "multi-user.target"}, "multi-user.target"},
+		{[]string{"graphical.target", "basic.target"}, "basic.target"},
+		{[]string{"rescue.target", "graphical.target"}, "graphical.target"},
+		{[]string{"rescue.target"}, "rescue.target"},
+	}
+	for _, test := range tests {
+		s := Service{Name: "foo.service", WantedBy: test.wantedBy}
+		if home := s.homeTarget(); home != test.home {
+			t.Errorf("%q: got %q, want %q", test.wantedBy, home, test.home)
+		}
+	}
+}
+
+func TestConflictsWith(t *testing.T) {
+	a := &Service{Name: "a.service", Conflicts: []string{"b.service"}}
+	b := &Service{Name: "b.service"}
+	c := &Service{Name: "c.service", Requires: []string{"a.service"}}
+
+	if !a.conflictsWith(b) || !b.conflictsWith(a) {
+		t.Errorf("a and b should conflict both ways")
+	}
+	if a.conflictsWith(c) || c.conflictsWith(a) || b.conflictsWith(c) {
+		t.Errorf("c conflicts with nothing")
+	}
+}
+
+func TestDependents(t *testing.T) {
+	defer loadServices(nil,
+		&Service{Name: "db.service", State: Started},
+		&Service{Name: "app.service", State: Started, Requires: []string{"db.service"}},
+		&Service{Name: "web.service", State: Starting, BindsTo: []string{"app.service"}},
+		&Service{Name: "admin.service", State: Started, Requires: []string{"web.service"}},
+		&Service{Name: "worker.service", State: Started, PartOf: []string{"db.service"}},
+		&Service{Name: "cache.service", State: Started, Wants: []string{"db.service"}},
+		&Service{Name: "report.service", State: Stopped, Requires: []string{"app.service"}},
+		&Service{Name: "backup.service", State: Errored, BindsTo: []string{"db.service"}},
+	)()
+
+	tests := []struct {
+		name     ServiceName
+		required bool
+		want     string
+		// each one before the ones it depends on
+		before [][2]ServiceName
+	}{
+		{"db.service", true, "admin.service,app.service,web.service,worker.service",
+			[][2]ServiceName{{"admin.service", "web.service"}, {"web.service", "app.service"}}},
+		// Only the ones stopping with it anyway
+		{"db.service", false, "worker.service", nil},
+		{"app.service", false, "web.service", nil},
+		{"app.service", true, "admin.service,web.service", [][2]ServiceName{{"admin.service", "web.service"}}},
+		{"admin.service", true, "", nil},
+	}
+	for _, test := range tests {
+		deps := dependents(LoadedServices[test.name], test.required)
+		position := make(map[ServiceName]int)
+		var names []ServiceName
+		for i, d := range deps {
+			position[d.Name] = i
+			names = append(names, d.Name)
+		}
+		if got := sortedNames(names); got != test.want {
+			t.Errorf("%s required %v: got %q, want %q", test.name, test.required, got, test.want)
+			continue
+		}
+		for _, b := range test.before {
+			if position[b[0]] > position[b[1]] {
+				t.Errorf("%s required %v: %s comes after %s in %v", test.name, test.required, b[0], b[1], names)
+			}
+		}
+	}
+}
+
+func TestDependsOn(t *testing.T) {
+	s := Service{Requires: []string{"a"}, BindsTo: []string{"b"}, PartOf: []string{"c"}, Wants: []string{"d"}, After: []string{"e"}}
+
+	tests := []struct {
+		name     ServiceName
+		required bool
+		want     bool
+	}{
+		{"a", true, true},
+		{"a", false, false},
+		{"b", false, true},
+		{"c", false, true},
+		{"d", true, false},
+		{"e", true, false},
+	}
+	for _, test := range tests {
+		if got := s.dependsOn(test.name, test.required); got != test.want {
+			t.Errorf("%s required %v: got %v, want %v", test.name, test.required, got, test.want)
+		}
+	}
+}
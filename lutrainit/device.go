@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Device is the uevent properties of a device: SUBSYSTEM, DEVNAME, INTERFACE...
+type Device map[string]string
+
+var (
+	// Devices present, by DEVPATH, filled by the uevent monitor
+	Devices   = make(map[string]Device)
+	DevicesMu sync.RWMutex
+)
+
+// DeviceMatch matches the devices with all its properties, the values are glob patterns
+type DeviceMatch struct {
+	Spec  string // as written, KEY=VAL,KEY=VAL
+	Props map[string]string
+}
+
+func (m DeviceMatch) String() string {
+	return m.Spec
+}
+
+// parseDeviceMatch parses a WantedByDevice like SUBSYSTEM=net,INTERFACE=eth0
+func parseDeviceMatch(spec string) (DeviceMatch, error) {
+	m := DeviceMatch{Spec: spec, Props: make(map[string]string)}
+	for _, prop := range strings.Split(spec, ",") {
+		kv := strings.SplitN(strings.TrimSpace(prop), "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return m, fmt.Errorf("invalid device property %s", prop)
+		}
+		if _, err := filepath.Match(kv[1], ""); err != nil {
+			return m, fmt.Errorf("invalid device property %s: %s", prop, err.Error())
+		}
+		m.Props[strings.ToUpper(kv[0])] = kv[1]
+	}
+	return m, nil
+}
+
+// pathDeviceMatch matches the device of a BindsToDevice, a /dev node or a /sys directory
+func pathDeviceMatch(path string) (DeviceMatch, error) {
+	path = filepath.Clean(path)
+	switch {
+	case strings.HasPrefix(path, "/dev/"):
+		return DeviceMatch{Spec: path, Props: map[string]string{"DEVNAME": strings.TrimPrefix(path, "/dev/")}}, nil
+	case strings.HasPrefix(path, "/sys/"):
+		return DeviceMatch{Spec: path, Props: map[string]string{"DEVPATH": strings.TrimPrefix(path, "/sys")}}, nil
+	}
+	return DeviceMatch{}, fmt.Errorf("%s is not in /dev or /sys", path)
+}
+
+func (m DeviceMatch) matches(d Device) bool {
+	for key, pattern := range m.Props {
+		val, ok := d[key]
+		if !ok {
+			return false
+		}
+		// The kernel gives DEVNAME relative to /dev
+		if key == "DEVNAME" {
+			val = strings.TrimPrefix(val, "/dev/")
+		}
+		if matched, _ := filepath.Match(pattern, val); !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// present if a device matching m is, DevicesMu must be held
+func (m DeviceMatch) present() bool {
+	for _, d := range Devices {
+		if m.matches(d) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasDevice if it is started when its devices appear and stopped when they go away
+func (s Service) hasDevice() bool {
+	return s.BindsToDevice != "" || len(s.WantedByDevice) > 0
+}
+
+// deviceMatches of its BindsToDevice and WantedByDevice
+func (s Service) deviceMatches() []DeviceMatch {
+	matches := append([]DeviceMatch{}, s.WantedByDevice...)
+	if m, err := pathDeviceMatch(s.BindsToDevice); err == nil {
+		matches = append(matches, m)
+	}
+	return matches
+}
+
+// matchesDevice if d is one of its devices
+func (s Service) matchesDevice(d Device) bool {
+	for _, m := range s.deviceMatches() {
+		if m.matches(d) {
+			return true
+		}
+	}
+	return false
+}
+
+// boundDevicePresent if it has no BindsToDevice, or if it is present
+func (s Service) boundDevicePresent() bool {
+	m, err := pathDeviceMatch(s.BindsToDevice)
+	if err != nil {
+		return true
+	}
+	DevicesMu.RLock()
+	defer DevicesMu.RUnlock()
+	return m.present()
+}
+
+// devicePresent if its BindsToDevice is present, and one of its WantedByDevice
+func (s Service) devicePresent() bool {
+	if !s.boundDevicePresent() {
+		return false
+	}
+	if len(s.WantedByDevice) == 0 {
+		return true
+	}
+	DevicesMu.RLock()
+	defer DevicesMu.RUnlock()
+	for _, m := range s.WantedByDevice {
+		if m.present() {
+			return true
+		}
+	}
+	return false
+}
+
+// deviceStatus of its devices for lutractl, with whether they are present
+func (s Service) deviceStatus() []string {
+	DevicesMu.RLock()
+	defer DevicesMu.RUnlock()
+
+	var status []string
+	for _, m := range s.deviceMatches() {
+		kind := "WantedByDevice"
+		if m.Spec == filepath.Clean(s.BindsToDevice) {
+			kind = "BindsToDevice"
+		}
+		state := "missing"
+		if m.present() {
+			state = "present"
+		}
+		status = append(status, fmt.Sprintf("%s %s, %s", kind, m.Spec, state))
+	}
+	sort.Strings(status)
+	return status
+}
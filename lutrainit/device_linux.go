@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"github.com/go-clog/clog"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// ueventBufferSize is the receive buffer of the uevent socket, plugging a disk sends a burst
+const ueventBufferSize = 1024 * 1024
+
+// startDeviceMonitor listens to the uevents of the kernel, then looks for the devices already
+// present, so that none is missed in between
+func startDeviceMonitor() {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_KOBJECT_UEVENT)
+	if err != nil {
+		clog.Error(2, "[lutra] Cannot open the uevent socket, devices are not watched: %s", err.Error())
+		return
+	}
+	// Group 1 is the kernel one, udev sends its own events to group 2
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: 1}); err != nil {
+		syscall.Close(fd)
+		clog.Error(2, "[lutra] Cannot bind the uevent socket, devices are not watched: %s", err.Error())
+		return
+	}
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUFFORCE, ueventBufferSize); err != nil {
+		syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF, ueventBufferSize)
+	}
+
+	scanDevices()
+	go watchUevents(fd)
+}
+
+// scanDevices fills Devices with the ones in /sys/devices
+func scanDevices() {
+	devices := make(map[string]Device)
+	filepath.Walk("/sys/devices", func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() || fi.Name() != "uevent" {
+			return nil
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil
+		}
+
+		dir := filepath.Dir(path)
+		d := Device{"DEVPATH": strings.TrimPrefix(dir, "/sys")}
+		for _, line := range strings.Split(string(content), "\n") {
+			if kv := strings.SplitN(line, "=", 2); len(kv) == 2 {
+				d[kv[0]] = kv[1]
+			}
+		}
+		// Not in the uevent file, but in the events
+		if subsystem, err := os.Readlink(filepath.Join(dir, "subsystem")); err == nil {
+			d["SUBSYSTEM"] = filepath.Base(subsystem)
+		}
+		devices[d["DEVPATH"]] = d
+		return nil
+	})
+
+	DevicesMu.Lock()
+	Devices = devices
+	DevicesMu.Unlock()
+	clog.Info("[lutra] Found %d devices", len(devices))
+}
+
+// watchUevents updates Devices with the uevents received on fd, and starts or stops the
+// services of the devices which appeared or went away
+func watchUevents(fd int) {
+	buf := make([]byte, 64*1024)
+	for {
+		n, from, err := syscall.Recvfrom(fd, buf, 0)
+		if err == syscall.EINTR {
+			continue
+		} else if err == syscall.ENOBUFS {
+			// Some were lost, look again at what is there
+			clog.Warn("[lutra] Too many uevents, scanning the devices again")
+			scanDevices()
+			continue
+		} else if err != nil {
+			clog.Error(2, "[lutra] Cannot receive uevents anymore, devices are not watched: %s", err.Error())
+			syscall.Close(fd)
+			return
+		}
+		// Only the kernel, no one else must make us start services
+		if sa, ok := from.(*syscall.SockaddrNetlink); !ok || sa.Pid != 0 {
+			continue
+		}
+
+		if action, d := parseUevent(buf[:n]); d != nil {
+			handleUevent(action, d)
+		}
+	}
+}
+
+// parseUevent parses "ACTION@DEVPATH\0KEY=VAL\0..."
+func parseUevent(msg []byte) (string, Device) {
+	fields := bytes.Split(msg, []byte{0})
+	if len(fields) < 2 || !bytes.Contains(fields[0], []byte("@")) {
+		return "", nil
+	}
+	d := make(Device)
+	for _, field := range fields[1:] {
+		if kv := strings.SplitN(string(field), "=", 2); len(kv) == 2 {
+			d[kv[0]] = kv[1]
+		}
+	}
+	if d["ACTION"] == "" || d["DEVPATH"] == "" {
+		return "", nil
+	}
+	action := d["ACTION"]
+	delete(d, "ACTION")
+	delete(d, "SEQNUM")
+	return action, d
+}
+
+// handleUevent updates Devices, starts the services of a device added and stops the ones of a
+// device removed, when it was their last one
+func handleUevent(action string, d Device) {
+	var old Device // the device gone
+	DevicesMu.Lock()
+	switch action {
+	case "add", "change", "bind", "online":
+		Devices[d["DEVPATH"]] = d
+	case "remove":
+		old = d
+		delete(Devices, d["DEVPATH"])
+	case "move":
+		// A renamed interface, eth0 becoming enp3s0
+		old = Devices[d["DEVPATH_OLD"]]
+		delete(Devices, d["DEVPATH_OLD"])
+		delete(d, "DEVPATH_OLD")
+		Devices[d["DEVPATH"]] = d
+	}
+	DevicesMu.Unlock()
+
+	appeared := action == "add" || action == "move"
+	if !appeared && old == nil {
+		return
+	}
+	clog.Trace("[lutra] Device %s %s", action, d["DEVPATH"])
+
+	var toStart, toStop []*Service
+	LoadedServicesMu.RLock()
+	for _, s := range LoadedServices {
+		if !s.hasDevice() || ShuttingDown {
+			continue
+		}
+		switch {
+		case appeared && s.matchesDevice(d) && s.devicePresent() &&
+			(s.State == NotStarted || s.State == Stopped || s.State == Errored):
+			toStart = append(toStart, s)
+		case old != nil && s.matchesDevice(old) && !s.devicePresent() &&
+			(s.State == Starting || s.State == Started):
+			toStop = append(toStop, s)
+		}
+	}
+	LoadedServicesMu.RUnlock()
+
+	for _, s := range toStop {
+		clog.Info("[lutra] Device %s went away, stopping %s", old["DEVPATH"], s.Name)
+		go func(s *Service) {
+			if err := CheckAndStopService(s); err != nil {
+				clog.Error(2, "[lutra] Cannot stop %s: %s", s.Name, err.Error())
+			}
+		}(s)
+	}
+	for _, s := range toStart {
+		clog.Info("[lutra] Device %s appeared, starting %s", d["DEVPATH"], s.Name)
+		go func(s *Service) {
+			if err := CheckAndStartService(s); err != nil {
+				clog.Error(2, "[lutra] Cannot start %s: %s", s.Name, err.Error())
+			}
+		}(s)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+var envNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// checkEnvironment validates a KEY=VAL assignment
+func checkEnvironment(kv string) error {
+	parts := strings.SplitN(kv, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("%s is not a KEY=VAL assignment", kv)
+	}
+	if !envNameRegexp.MatchString(parts[0]) {
+		return fmt.Errorf("invalid variable name %s", parts[0])
+	}
+	return nil
+}
+
+// setEnv sets the KEY=VAL assignment kv in env, replacing a previous value of KEY
+func setEnv(env []string, kv string) []string {
+	prefix := kv[:strings.Index(kv, "=")+1]
+	for i, e := range env {
+		if strings.HasPrefix(e, prefix) {
+			env[i] = kv
+			return env
+		}
+	}
+	return append(env, kv)
+}
+
+// unquote removes the quotes around val
+func unquote(val string) string {
+	if len(val) >= 2 && (val[0] == '"' || val[0] == '\'') && val[len(val)-1] == val[0] {
+		return val[1 : len(val)-1]
+	}
+	return val
+}
+
+// parseEnvironment parses the raw body of the [environment] section of lutra.conf,
+// names keep their case and spaces around = are allowed like in the other sections
+func parseEnvironment(body string) (env []string, err error) {
+	for _, line := range strings.Split(body, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%s is not a KEY=VAL assignment", line)
+		}
+		kv := fmt.Sprintf("%s=%s", strings.TrimSpace(parts[0]), unquote(strings.TrimSpace(parts[1])))
+		if err := checkEnvironment(kv); err != nil {
+			return nil, err
+		}
+		env = append(env, kv)
+	}
+	return env, nil
+}
+
+// readEnvironmentFile reads the KEY=VAL lines of path, empty lines and # comments are skipped
+func readEnvironmentFile(path string) (env []string, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+
+		if err := checkEnvironment(line); err != nil {
+			return nil, fmt.Errorf("%s line %d: %s", path, n, err.Error())
+		}
+		parts := strings.SplitN(line, "=", 2)
+		env = append(env, fmt.Sprintf("%s=%s", parts[0], unquote(parts[1])))
+	}
+
+	return env, scanner.Err()
+}
+
+// environment of the processes of the service: the one of lutrainit, then the [environment] of
+// lutra.conf, the EnvironmentFile and finally the Environment of the service.
+// Files are read on each start, so they can be changed without a reload.
+func (s Service) environment() ([]string, error) {
+	env := os.Environ()
+
+	for _, kv := range MainConfig.Environment {
+		env = setEnv(env, kv)
+	}
+
+	if s.User != "" {
+		u, err := lookupUser(s.User)
+		if err != nil {
+			return nil, fmt.Errorf("unknown User %s: %s", s.User, err.Error())
+		}
+		env = setEnv(env, fmt.Sprintf("USER=%s", u.Username))
+		env = setEnv(env, fmt.Sprintf("LOGNAME=%s", u.Username))
+		env = setEnv(env, fmt.Sprintf("HOME=%s", u.HomeDir))
+	}
+
+	for _, path := range s.EnvironmentFiles {
+		// -/etc/default/foo can be missing
+		optional := strings.HasPrefix(path, "-")
+		path = strings.TrimPrefix(path, "-")
+
+		fileEnv, err := readEnvironmentFile(path)
+		if os.IsNotExist(err) && optional {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot read EnvironmentFile: %s", err.Error())
+		}
+		for _, kv := range fileEnv {
+			env = setEnv(env, kv)
+		}
+	}
+
+	for _, kv := range s.Environment {
+		env = setEnv(env, kv)
+	}
+
+	return env, nil
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/urfave/cli"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"syscall"
+)
+
+const (
+	// execParamsEnv passes the ExecParams to lutrainit exec-service, it is removed before the command runs
+	execParamsEnv = "LUTRAINIT_EXEC_PARAMS"
+	// execFailedCode is the exit code of exec-service when it cannot set up the process
+	execFailedCode = 126
+)
+
+// execHelperPath is the lutrainit binary which runs exec-service
+var execHelperPath = "/proc/self/exe"
+
+// CmdExecService cli command, used by lutrainit itself to set up the processes of the services
+var CmdExecService = cli.Command{
+	Name:        "exec-service",
+	Usage:       "Internal, sets up a process of a service and runs its command",
+	Description: "Internal, sets up a process of a service and runs its command",
+	Action:      execService,
+	Hidden:      true,
+	Flags:       []cli.Flag{},
+}
+
+// Rlimit of a service, Resource is the RLIMIT_* number
+type Rlimit struct {
+	Resource int
+	Cur      uint64
+	Max      uint64
+}
+
+// ExecParams is what must be done in the process of a service between the fork and the exec of
+// its command, when the exec.Cmd attributes are not enough.
+// Credentials are dropped after the settings which need root, only the ambient capabilities come later.
+type ExecParams struct {
+	Command string
+	Name    ServiceName
+
+	Rlimits    []Rlimit
+	Scheduling Scheduling
+	Sandbox    Sandbox
+
+	Capabilities Capabilities
+	Credential   *syscall.Credential
+
+	// LISTEN_PID of socket activation is the pid of the command, only known here
+	ListenPID bool
+
+	// Installed last, it may deny what the settings need
+	Seccomp Seccomp
+}
+
+// execParams returns the params of the process of s, nil when it doesn't need exec-service
+func (s Service) execParams(line string, cred *syscall.Credential, listenPID bool) *ExecParams {
+	p := &ExecParams{
+		Command:      line,
+		Name:         s.Name,
+		Rlimits:      s.rlimits(),
+		Scheduling:   s.Scheduling,
+		Sandbox:      s.Sandbox,
+		Capabilities: s.Capabilities,
+		Credential:   cred,
+		Seccomp:      s.Seccomp,
+		ListenPID:    listenPID,
+	}
+	// An instance has its own PrivateTmp
+	if s.Instance != "" {
+		p.Name = s.Instance
+	}
+
+	if len(p.Rlimits) == 0 && !p.Scheduling.IsSet() && !p.Sandbox.IsSet() && !p.Capabilities.IsSet() && !p.Seccomp.IsSet() && !p.ListenPID {
+		return nil
+	}
+	return p
+}
+
+// rlimits of the service, over the defaults of lutra.conf
+func (s Service) rlimits() []Rlimit {
+	limits := make([]Rlimit, 0, len(MainConfig.Rlimits)+len(s.Rlimits))
+	set := func(l Rlimit) {
+		for i := range limits {
+			if limits[i].Resource == l.Resource {
+				limits[i] = l
+				return
+			}
+		}
+		limits = append(limits, l)
+	}
+
+	for _, l := range MainConfig.Rlimits {
+		set(l)
+	}
+	for _, l := range s.Rlimits {
+		set(l)
+	}
+	return limits
+}
+
+// wrap makes cmd run lutrainit exec-service, which applies p and then runs the command
+func (p *ExecParams) wrap(cmd *exec.Cmd) error {
+	params, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	cmd.Path = execHelperPath
+	cmd.Args = []string{"lutrainit", CmdExecService.Name}
+	cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", execParamsEnv, params))
+	// exec-service drops them itself, after what needs root
+	cmd.SysProcAttr.Credential = nil
+
+	return nil
+}
+
+// parseRlimit parses "soft:hard", or a single value for both, values are numbers with K, M, G or T
+// suffixes or infinity
+func parseRlimit(resource int, val string) (Rlimit, error) {
+	l := Rlimit{Resource: resource}
+
+	parts := strings.SplitN(val, ":", 2)
+	if len(parts) == 1 {
+		parts = append(parts, parts[0])
+	}
+
+	values := make([]uint64, 2)
+	for i, part := range parts {
+		limit, err := parseLimit(part, true)
+		if err != nil {
+			return l, err
+		}
+		if limit == "" {
+			return l, fmt.Errorf("empty limit in %s", val)
+		}
+		if limit == "max" {
+			values[i] = rlimInfinity
+			continue
+		}
+		fmt.Sscanf(limit, "%d", &values[i])
+	}
+
+	l.Cur, l.Max = values[0], values[1]
+	if l.Cur > l.Max {
+		return l, fmt.Errorf("soft limit is over the hard one in %s", val)
+	}
+	return l, nil
+}
+
+// execService is run in the forked process: it applies the ExecParams and replaces itself by the command
+func execService(ctx *cli.Context) error {
+	// Many settings are per thread, they must be on the one doing the exec
+	runtime.LockOSThread()
+
+	var p ExecParams
+	if err := json.Unmarshal([]byte(os.Getenv(execParamsEnv)), &p); err != nil {
+		execFailed("invalid %s: %s", execParamsEnv, err.Error())
+	}
+
+	env := make([]string, 0, len(os.Environ()))
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, execParamsEnv+"=") {
+			env = append(env, kv)
+		}
+	}
+	if p.ListenPID {
+		// The shell execs the command, which keeps this pid
+		env = append(env, fmt.Sprintf("LISTEN_PID=%d", os.Getpid()))
+	}
+
+	for _, l := range p.Rlimits {
+		if err := setRlimit(l); err != nil {
+			execFailed("cannot set limit %s: %s", rlimitName(l.Resource), err.Error())
+		}
+	}
+
+	if err := p.Scheduling.apply(); err != nil {
+		execFailed("%s", err.Error())
+	}
+
+	if err := p.Sandbox.apply(p.Name); err != nil {
+		execFailed("%s", err.Error())
+	}
+
+	if err := p.Capabilities.limit(); err != nil {
+		execFailed("%s", err.Error())
+	}
+
+	if c := p.Credential; c != nil {
+		if err := dropCredential(c); err != nil {
+			execFailed("cannot change user: %s", err.Error())
+		}
+	}
+
+	if err := p.Capabilities.raise(); err != nil {
+		execFailed("%s", err.Error())
+	}
+
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		execFailed("%s", err.Error())
+	}
+
+	if err := p.Seccomp.install(); err != nil {
+		execFailed("%s", err.Error())
+	}
+
+	err = syscall.Exec(sh, []string{"sh", "-c", p.Command}, env)
+	execFailed("cannot run %s: %s", p.Command, err.Error())
+	return nil
+}
+
+// execFailed ends exec-service, the message goes to the output of the service
+func execFailed(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "lutrainit exec-service: %s\n", fmt.Sprintf(format, args...))
+	os.Exit(execFailedCode)
+}
+
+func dropCredential(c *syscall.Credential) error {
+	groups := make([]int, 0, len(c.Groups))
+	for _, g := range c.Groups {
+		groups = append(groups, int(g))
+	}
+	if err := syscall.Setgroups(groups); err != nil {
+		return err
+	}
+	if err := syscall.Setgid(int(c.Gid)); err != nil {
+		return err
+	}
+	return syscall.Setuid(int(c.Uid))
+}
+
+// rlimitName returns "NOFILE" for RLIMIT_NOFILE
+func rlimitName(resource int) string {
+	for name, r := range rlimitResources {
+		if r == resource {
+			return name
+		}
+	}
+	return fmt.Sprintf("%d", resource)
+}
@@ -180,7 +180,8 @@ func spawnGetty(autologin, tty string, idx int) error {
 	cmd.Stdin = os.Stdin
 	cmd.Stderr = os.Stderr
 
-	if err := cmd.Start(); err != nil {
+	child, err := startChild(cmd)
+	if err != nil {
 		clog.Error(2, "[lutra] Getty %s exited with error: %s", tty, err.Error())
 		return err
 	}
@@ -189,5 +190,5 @@ func spawnGetty(autologin, tty string, idx int) error {
 	GettysList[idx].PID = cmd.Process.Pid
 	GettysListMu.Unlock()
 
-	return cmd.Wait()
+	return child.Wait()
 }
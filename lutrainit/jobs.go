@@ -0,0 +1,307 @@
+package main
+
+import (
+	"fmt"
+	"github.com/go-clog/clog"
+	"sync"
+)
+
+var (
+	// BootJobs are the jobs of the boot in progress, protected by LoadedServicesMu
+	BootJobs = make(map[ServiceName]*BootJob)
+
+	// serviceStateChanged is broadcasted on every change of state of a service or of a boot job.
+	// Wait() on it with LoadedServicesMu locked.
+	serviceStateChanged = sync.NewCond(&LoadedServicesMu)
+)
+
+// BootJob is the start of a service, or the reach of a target, during the boot.
+// It runs as soon as all the jobs it depends on are finished.
+type BootJob struct {
+	Name ServiceName
+
+	Deps     []ServiceName // Jobs to wait for: Requires, Wants, BindsTo, PartOf, After, Before from the other side and the target ordering
+	Required []ServiceName // Deps which must not fail: Requires and BindsTo
+
+	Finished bool
+	Failed   bool
+	Reason   string
+}
+
+// StartServices starts all declared services at boot.
+// Every service has its own job, waiting for state changes of the jobs it depends on, so
+// services from different targets run in parallel when their dependencies allow it.
+func StartServices() {
+	// Still sort them, mostly to catch the dependency cycles between targets
+	if err := SortServicesForBoot(); err != nil {
+		clog.Error(2, "[lutra] Cannot sort services for boot: %s", err.Error())
+	}
+
+	LoadedServicesMu.Lock()
+	BootJobs = newBootJobs()
+	breakJobCycles(BootJobs)
+	LoadedServicesMu.Unlock()
+
+	wg := sync.WaitGroup{}
+	wg.Add(len(BootJobs))
+	for _, job := range BootJobs {
+		go func(j *BootJob) {
+			defer wg.Done()
+			j.run()
+		}(job)
+	}
+	wg.Wait() // Wait until all the jobs are finished
+}
+
+// newBootJobs creates the jobs of all loaded services and targets, LoadedServicesMu must be held
+func newBootJobs() map[ServiceName]*BootJob {
+	jobs := make(map[ServiceName]*BootJob)
+	for name := range LoadedServices {
+		jobs[name] = &BootJob{Name: name}
+	}
+
+	// link makes the job of name wait for the job of dep, unknown services are ignored as
+	// they are already reported by ReloadConfig
+	link := func(name, dep ServiceName, required bool) {
+		if _, ok := jobs[dep]; !ok {
+			return
+		}
+		if j, ok := jobs[name]; ok {
+			j.addDep(dep, required)
+		}
+	}
+
+	// Direct dependencies
+	for name, s := range LoadedServices {
+		for _, req := range s.Requires {
+			link(name, ServiceName(req), true)
+		}
+		for _, req := range s.BindsTo {
+			link(name, ServiceName(req), true)
+		}
+		for _, want := range s.Wants {
+			link(name, ServiceName(want), false)
+		}
+		for _, p := range s.PartOf {
+			link(name, ServiceName(p), false)
+		}
+		for _, aft := range s.After {
+			link(name, ServiceName(aft), false)
+		}
+		for _, bf := range s.Before {
+			link(ServiceName(bf), name, false)
+		}
+		// A service started at boot gets the sockets it is activated by
+		if s.IsSocket() {
+			link(s.SocketService, name, false)
+		}
+	}
+
+	// Services follow the ordering of their target, and a target is reached once all the
+	// services it wants are finished.
+	targetDeps := make(map[ServiceName]BootJob)
+	for name, s := range LoadedServices {
+		if s.IsTarget() {
+			targetDeps[name] = *jobs[name]
+		}
+	}
+	for name, s := range LoadedServices {
+		if !s.hasJob() {
+			continue
+		}
+		// Ordered with its first target only, the later ones wait for it
+		if home, ok := targetDeps[s.homeTarget()]; ok {
+			for _, dep := range home.Deps {
+				link(name, dep, home.requires(dep))
+			}
+		}
+		for _, wb := range s.WantedBy {
+			link(ServiceName(wb), name, false)
+		}
+	}
+
+	return jobs
+}
+
+// breakJobCycles drops the dependencies making a cycle, else the jobs involved would wait forever
+func breakJobCycles(jobs map[ServiceName]*BootJob) {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	marks := make(map[ServiceName]int)
+
+	var visit func(j *BootJob)
+	visit = func(j *BootJob) {
+		marks[j.Name] = visiting
+		deps := make([]ServiceName, 0, len(j.Deps))
+		for _, dep := range j.Deps {
+			switch marks[dep] {
+			case visiting:
+				clog.Error(2, "[lutra] Dependency cycle between %s and %s, ignoring this dependency", j.Name, dep)
+				j.removeRequired(dep)
+				continue
+			case unvisited:
+				visit(jobs[dep])
+			}
+			deps = append(deps, dep)
+		}
+		j.Deps = deps
+		marks[j.Name] = visited
+	}
+
+	for _, j := range jobs {
+		if marks[j.Name] == unvisited {
+			visit(j)
+		}
+	}
+}
+
+func (j *BootJob) addDep(dep ServiceName, required bool) {
+	if dep == j.Name {
+		return
+	}
+	if required && !j.requires(dep) {
+		j.Required = append(j.Required, dep)
+	}
+	for _, d := range j.Deps {
+		if d == dep {
+			return
+		}
+	}
+	j.Deps = append(j.Deps, dep)
+}
+
+func (j *BootJob) requires(dep ServiceName) bool {
+	for _, d := range j.Required {
+		if d == dep {
+			return true
+		}
+	}
+	return false
+}
+
+func (j *BootJob) removeRequired(dep ServiceName) {
+	required := make([]ServiceName, 0, len(j.Required))
+	for _, d := range j.Required {
+		if d != dep {
+			required = append(required, d)
+		}
+	}
+	j.Required = required
+}
+
+// failedRequirement returns why the job cannot run if a required job failed, LoadedServicesMu must be held
+func (j *BootJob) failedRequirement() (failed bool, reason string) {
+	for _, dep := range j.Required {
+		if d := BootJobs[dep]; d.Finished && d.Failed {
+			return true, fmt.Sprintf("required %s failed: %s", dep, d.Reason)
+		}
+	}
+	return false, ""
+}
+
+// depsFinished if all the jobs it depends on are, LoadedServicesMu must be held
+func (j *BootJob) depsFinished() bool {
+	for _, dep := range j.Deps {
+		if !BootJobs[dep].Finished {
+			return false
+		}
+	}
+	return true
+}
+
+// finish the job and wake up the ones waiting for it, LoadedServicesMu must be held
+func (j *BootJob) finish(failed bool, reason string) {
+	j.Finished = true
+	j.Failed = failed
+	j.Reason = reason
+	serviceStateChanged.Broadcast()
+}
+
+// run waits for the dependencies to finish and then starts the service
+func (j *BootJob) run() {
+	LoadedServicesMu.Lock()
+	for !j.depsFinished() {
+		if failed, reason := j.failedRequirement(); failed {
+			j.fail(reason)
+			LoadedServicesMu.Unlock()
+			return
+		}
+		serviceStateChanged.Wait()
+	}
+	if failed, reason := j.failedRequirement(); failed {
+		j.fail(reason)
+		LoadedServicesMu.Unlock()
+		return
+	}
+
+	s := LoadedServices[j.Name]
+
+	switch {
+	case s.IsTarget() || s.Type == "virtual" || s.IsTemplate():
+		// Nothing to start, all its dependencies are finished
+		clog.Trace("[lutra] Reached %s", s.Name)
+		j.finish(false, "")
+		LoadedServicesMu.Unlock()
+		return
+	case s.State == Started:
+		j.finish(false, "")
+		LoadedServicesMu.Unlock()
+		return
+	// Started at boot when its device is present, whatever its Autostart, as when it appears
+	case s.hasDevice() && !s.devicePresent():
+		j.finish(true, "its device is not present")
+		LoadedServicesMu.Unlock()
+		return
+	case !s.AutoStart && !s.hasDevice():
+		j.finish(true, "not started at boot")
+		LoadedServicesMu.Unlock()
+		return
+	case s.State != NotStarted:
+		j.finish(true, fmt.Sprintf("service is %s", s.State.String()))
+		LoadedServicesMu.Unlock()
+		return
+	}
+	LoadedServicesMu.Unlock()
+
+	if s.IsSocket() || s.IsTimer() || s.IsPath() {
+		err := CheckAndStartService(s)
+		LoadedServicesMu.Lock()
+		defer LoadedServicesMu.Unlock()
+		if err != nil {
+			j.finish(true, err.Error())
+			return
+		}
+		j.finish(false, "")
+		return
+	}
+
+	stopConflicts(s)
+
+	// Simple services are started in background, wait for them to leave the starting state
+	LoadedServicesMu.Lock()
+	defer LoadedServicesMu.Unlock()
+	launch(s)
+	for s.State == NotStarted || s.State == Starting {
+		serviceStateChanged.Wait()
+	}
+	if s.State != Started {
+		j.finish(true, s.LastMessage)
+		return
+	}
+	j.finish(false, "")
+}
+
+// fail the job without starting its service, LoadedServicesMu must be held
+func (j *BootJob) fail(reason string) {
+	clog.Error(2, "[lutra] Not starting %s: %s", j.Name, reason)
+
+	s := LoadedServices[j.Name]
+	if s.hasJob() && s.AutoStart {
+		setState(j.Name, Errored)
+		s.LastMessage = reason
+	}
+	j.finish(true, reason)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+// loadServices replaces the loaded services and targets, the returned func restores them
+func loadServices(targets []ServiceName, services ...*Service) func() {
+	savedServices, savedTargets := LoadedServices, OrderedTargets
+	LoadedServices = make(map[ServiceName]*Service)
+	for _, s := range services {
+		LoadedServices[s.Name] = s
+	}
+	OrderedTargets = targets
+	return func() { LoadedServices, OrderedTargets = savedServices, savedTargets }
+}
+
+// namesOf names, as strings
+func namesOf(names []ServiceName) []string {
+	list := make([]string, 0, len(names))
+	for _, n := range names {
+		list = append(list, string(n))
+	}
+	return list
+}
+
+// sortedNames of names, joined by commas
+func sortedNames(names []ServiceName) string {
+	list := namesOf(names)
+	sort.Strings(list)
+	return strings.Join(list, ",")
+}
+
+func TestNewBootJobs(t *testing.T) {
+	defer loadServices([]ServiceName{"basic.target", "multi-user.target"},
+		&Service{Name: "basic.target"},
+		&Service{Name: "multi-user.target", Requires: []string{"basic.target"}},
+		&Service{Name: "network.service", WantedBy: []string{"basic.target"}},
+		&Service{Name: "sshd.service", WantedBy: []string{"multi-user.target"}, Requires: []string{"network.service"}, After: []string{"syslog.service"}},
+		&Service{Name: "syslog.service", WantedBy: []string{"multi-user.target"}, Before: []string{"cron.service"}},
+		&Service{Name: "cron.service", WantedBy: []string{"multi-user.target", "basic.target"}},
+		&Service{Name: "web.service", Requires: []string{"missing.service", "web.service"}},
+	)()
+
+	tests := []struct {
+		name           ServiceName
+		deps, required string
+	}{
+		{"basic.target", "cron.service,network.service", ""},
+		{"multi-user.target", "basic.target,cron.service,sshd.service,syslog.service", "basic.target"},
+		{"network.service", "", ""},
+		// The requirements of its target are its own
+		{"sshd.service", "basic.target,network.service,syslog.service", "basic.target,network.service"},
+		{"syslog.service", "basic.target", "basic.target"},
+		// Ordered with basic.target, the first of its targets reached
+		{"cron.service", "syslog.service", ""},
+		{"web.service", "", ""},
+	}
+
+	jobs := newBootJobs()
+	if len(jobs) != len(tests) {
+		t.Errorf("got %d jobs, want %d", len(jobs), len(tests))
+	}
+	for _, test := range tests {
+		j, ok := jobs[test.name]
+		if !ok {
+			t.Errorf("%s has no job", test.name)
+			continue
+		}
+		if deps := sortedNames(j.Deps); deps != test.deps {
+			t.Errorf("%s: got deps %q, want %q", test.name, deps, test.deps)
+		}
+		if required := sortedNames(j.Required); required != test.required {
+			t.Errorf("%s: got required %q, want %q", test.name, required, test.required)
+		}
+	}
+}
+
+func TestBreakJobCycles(t *testing.T) {
+	jobs := make(map[ServiceName]*BootJob)
+	for _, name := range []ServiceName{"a", "b", "c", "d"} {
+		jobs[name] = &BootJob{Name: name}
+	}
+	jobs["a"].addDep("b", true)
+	jobs["b"].addDep("c", true)
+	jobs["c"].addDep("a", true)
+	jobs["d"].addDep("a", false)
+	jobs["d"].addDep("d", true)
+
+	breakJobCycles(jobs)
+
+	for _, j := range jobs {
+		for _, dep := range j.Required {
+			if !contains(namesOf(j.Deps), string(dep)) {
+				t.Errorf("%s still requires %s, not one of its deps", j.Name, dep)
+			}
+		}
+	}
+	if n := len(jobs["a"].Deps) + len(jobs["b"].Deps) + len(jobs["c"].Deps); n != 2 {
+		t.Errorf("got %d dependencies left between a, b and c, want 2", n)
+	}
+	if deps := sortedNames(jobs["d"].Deps); deps != "a" {
+		t.Errorf("d: got deps %q, want %q", deps, "a")
+	}
+
+	// Nothing waits for itself anymore
+	var waits func(name, target ServiceName, seen map[ServiceName]bool) bool
+	waits = func(name, target ServiceName, seen map[ServiceName]bool) bool {
+		for _, dep := range jobs[name].Deps {
+			if dep == target {
+				return true
+			}
+			if !seen[dep] {
+				seen[dep] = true
+				if waits(dep, target, seen) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	for name := range jobs {
+		if waits(name, name, make(map[ServiceName]bool)) {
+			t.Errorf("%s still waits for itself", name)
+		}
+	}
+}
+
+func TestBootJobsDependencies(t *testing.T) {
+	defer loadServices(nil,
+		&Service{Name: "app.service", Wants: []string{"cache.service"}, BindsTo: []string{"db.service"},
+			PartOf: []string{"group.service"}, Conflicts: []string{"legacy.service"}},
+		&Service{Name: "app.socket", SocketService: "app.service"},
+		&Service{Name: "cache.service"},
+		&Service{Name: "db.service"},
+		&Service{Name: "group.service"},
+		&Service{Name: "legacy.service"},
+	)()
+
+	// Only BindsTo is required, and Conflicts doesn't order anything
+	j := newBootJobs()["app.service"]
+	if deps := sortedNames(j.Deps); deps != "app.socket,cache.service,db.service,group.service" {
+		t.Errorf("got deps %q", deps)
+	}
+	if required := sortedNames(j.Required); required != "db.service" {
+		t.Errorf("got required %q", required)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"github.com/go-clog/clog"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Kill modes, what gets signaled when stopping a service
+const (
+	KillProcess      = "process"       // only the main process
+	KillProcessGroup = "process-group" // the process group of the main process
+	KillControlGroup = "control-group" // the main process and all its children
+)
+
+const (
+	// sigkillTimeout is how long we wait for a process to die after a SIGKILL
+	sigkillTimeout = 5 * time.Second
+	// serviceStopGrace is the time given to each service to stop at shutdown, on top of its TimeoutStop
+	serviceStopGrace = 30 * time.Second
+)
+
+var signalsByName = map[string]syscall.Signal{
+	"SIGHUP":   syscall.SIGHUP,
+	"SIGINT":   syscall.SIGINT,
+	"SIGQUIT":  syscall.SIGQUIT,
+	"SIGKILL":  syscall.SIGKILL,
+	"SIGUSR1":  syscall.SIGUSR1,
+	"SIGUSR2":  syscall.SIGUSR2,
+	"SIGTERM":  syscall.SIGTERM,
+	"SIGCONT":  syscall.SIGCONT,
+	"SIGSTOP":  syscall.SIGSTOP,
+	"SIGWINCH": syscall.SIGWINCH,
+}
+
+// parseSignal accepts "SIGTERM", "TERM" or "15"
+func parseSignal(name string) (syscall.Signal, error) {
+	name = strings.ToUpper(strings.TrimSpace(name))
+	if num, err := strconv.Atoi(name); err == nil && num > 0 {
+		return syscall.Signal(num), nil
+	}
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	if sig, ok := signalsByName[name]; ok {
+		return sig, nil
+	}
+	return 0, fmt.Errorf("unknown signal %s", name)
+}
+
+// signalName returns "SIGTERM" for syscall.SIGTERM
+func signalName(sig syscall.Signal) string {
+	for name, s := range signalsByName {
+		if s == sig {
+			return name
+		}
+	}
+	return strconv.Itoa(int(sig))
+}
+
+// processRunning tells if pid still exists, and didn't exit already
+func processRunning(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	return syscall.Kill(pid, 0) == nil && !processZombie(pid)
+}
+
+// mainRunning tells if pid, the main process of s, is still running. A supervised one is running
+// until the supervisor reaped it and cleared LastKnownPID: its PID may be a zombie until then, or
+// be reused after.
+func mainRunning(s *Service, pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	if s.IsSupervised() {
+		LoadedServicesMu.RLock()
+		defer LoadedServicesMu.RUnlock()
+		return LoadedServices[s.Name].LastKnownPID == pid
+	}
+	return processRunning(pid)
+}
+
+// waitForExit waits until pid, the main process of s, died or timeout is reached, returns true if
+// it died
+func waitForExit(s *Service, pid int, timeout time.Duration) bool {
+	if s.IsSupervised() {
+		LoadedServicesMu.Lock()
+		defer LoadedServicesMu.Unlock()
+		return waitState(func() bool {
+			return LoadedServices[s.Name].LastKnownPID != pid
+		}, timeout)
+	}
+
+	// Not our child, nobody tells us
+	deadline := time.Now().Add(timeout)
+	for processRunning(pid) {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return true
+}
+
+// signalService sends sig to the main process pid of s, and to others depending on its KillMode
+func signalService(s *Service, pid int, sig syscall.Signal) {
+	switch s.KillMode {
+	case KillProcess:
+		syscall.Kill(pid, sig)
+	case KillProcessGroup:
+		// Never signal our own group
+		if pgid, err := syscall.Getpgid(pid); err == nil && pgid > 1 && pgid != syscall.Getpgrp() {
+			syscall.Kill(-pgid, sig)
+		} else {
+			syscall.Kill(pid, sig)
+		}
+	default:
+		// Its cgroup has everything it forked, even the double-forked daemons
+		pids, err := cgroupProcs(s.Name)
+		if err != nil {
+			pids = append([]int{pid}, processDescendants(pid)...)
+		}
+		for _, p := range pids {
+			syscall.Kill(p, sig)
+		}
+	}
+}
+
+// cgroupPopulated tells if processes are left in the cgroup of the service, when they are all killed on stop
+func cgroupPopulated(s *Service) bool {
+	if s.KillMode != KillControlGroup {
+		return false
+	}
+	pids, err := cgroupProcs(s.Name)
+	return err == nil && len(pids) > 0
+}
+
+// waitStopped waits for the main process pid to die, and for its whole cgroup to be empty in
+// control-group mode. It returns true if everything died before timeout.
+func waitStopped(s *Service, pid int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	if !waitForExit(s, pid, timeout) {
+		return false
+	}
+	for cgroupPopulated(s) {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return true
+}
+
+// killService sends the KillSignal to the service, then SIGKILL if it is still alive after TimeoutStop.
+// It returns the signal which ended the process.
+func killService(s *Service, pid int) (syscall.Signal, error) {
+	clog.Info("[lutra] Sending %s to service %s (PID %d)", signalName(s.KillSignal), s.Name, pid)
+	signalService(s, pid, s.KillSignal)
+	if waitStopped(s, pid, s.TimeoutStop) {
+		return s.KillSignal, nil
+	}
+
+	clog.Warn("[lutra] Service %s still alive after %s, sending SIGKILL", s.Name, s.TimeoutStop)
+	signalService(s, pid, syscall.SIGKILL)
+	if waitStopped(s, pid, sigkillTimeout) {
+		return syscall.SIGKILL, nil
+	}
+
+	return syscall.SIGKILL, fmt.Errorf("service %s (PID %d) is still alive after SIGKILL", s.Name, pid)
+}
@@ -7,13 +7,10 @@ import (
 	"github.com/go-clog/clog"
 	"github.com/valyala/gorpc"
 	"runtime"
+	"sort"
 	"time"
 )
 
-var (
-	startTime = time.Now()
-)
-
 func socketInitctl() {
 	d := gorpc.NewDispatcher()
 
@@ -50,6 +47,11 @@ func socketInitctl() {
 		return returnStatus(status)
 	})
 
+	// Returns the captured output of services
+	d.AddFunc("logs", func(req *ipc.AskLogs) *ipc.AnswerLogs {
+		return returnLogs(req)
+	})
+
 	d.AddFunc("reload", func() *ipc.AnswerReload {
 		err := ReloadConfig(true, "/etc/lutrainit", true)
 		if err != nil {
@@ -76,8 +78,27 @@ func socketInitctl() {
 	d.AddFunc("stop", func(req *ipc.ServiceAction) *ipc.ServiceActionAnswer {
 		answer := &ipc.ServiceActionAnswer{Name: req.Name, Action: ipc.Stop}
 
+		// The services depending on it first
 		if proc, exists := LoadedServices[ServiceName(req.Name)]; exists {
-			err := CheckAndStopService(proc)
+			deps, err := StopService(proc, req.NoDeps)
+			answer.Deps = serviceNames(deps)
+			if err != nil {
+				answer.Err = true
+				answer.ErrStr = err.Error()
+				return answer
+			}
+		}
+
+		return answer
+	})
+
+	// Restarts the services depending on it too
+	d.AddFunc("restart", func(req *ipc.ServiceAction) *ipc.ServiceActionAnswer {
+		answer := &ipc.ServiceActionAnswer{Name: req.Name, Action: ipc.Restart}
+
+		if proc, exists := LoadedServices[ServiceName(req.Name)]; exists {
+			deps, err := RestartService(proc, req.NoDeps)
+			answer.Deps = serviceNames(deps)
 			if err != nil {
 				answer.Err = true
 				answer.ErrStr = err.Error()
@@ -147,39 +168,44 @@ func returnStats() *ipc.SysStatus {
 		PauseTotalNs: fmt.Sprintf("%.1fs", float64(m.PauseTotalNs)/1000/1000/1000),
 		PauseNs:      fmt.Sprintf("%.3fs", float64(m.PauseNs[(m.NumGC+255)%256])/1000/1000/1000),
 		NumGC:        m.NumGC,
+
+		Services: servicesUsage(),
 	}
 }
 
+// servicesUsage of all the services with processes, the biggest memory users first
+func servicesUsage() []ipc.ServiceUsage {
+	LoadedServicesMu.RLock()
+	services := make([]*Service, 0, len(LoadedServices))
+	for _, s := range LoadedServices {
+		if s.IsService() && s.Type != "virtual" {
+			services = append(services, s)
+		}
+	}
+	LoadedServicesMu.RUnlock()
+
+	var usages []ipc.ServiceUsage
+	for _, s := range services {
+		if usage := serviceUsage(s); usage != nil {
+			usages = append(usages, *usage)
+		}
+	}
+	sort.Slice(usages, func(i, j int) bool {
+		return usages[i].Memory > usages[j].Memory
+	})
+	return usages
+}
+
 func returnStatus(req *ipc.AskStatus) (services map[ipc.ServiceName]*ipc.Service) {
 	services = make(map[ipc.ServiceName]*ipc.Service)
 
 	if req.All {
 		for k, v := range LoadedServices {
-			services[ipc.ServiceName(k)] = &ipc.Service{
-				Name:         ipc.ServiceName(v.Name),
-				Type:         v.Type,
-				Description:  v.Description,
-				State:        ipc.RunState(v.State),
-				LastKnownPID: v.LastKnownPID,
-				LastAction:   ipc.LastAction(v.LastAction),
-				LastActionAt: v.LastActionAt,
-				LastMessage:  v.LastMessage,
-				Deleted:      v.Deleted,
-			}
+			services[ipc.ServiceName(k)] = ipcService(v)
 		}
 	} else {
 		if proc, exists := LoadedServices[ServiceName(req.Name)]; exists {
-			services[ipc.ServiceName(proc.Name)] = &ipc.Service{
-				Name:         ipc.ServiceName(proc.Name),
-				Type:         proc.Type,
-				Description:  proc.Description,
-				State:        ipc.RunState(proc.State),
-				LastKnownPID: proc.LastKnownPID,
-				LastAction:   ipc.LastAction(proc.LastAction),
-				LastActionAt: proc.LastActionAt,
-				LastMessage:  proc.LastMessage,
-				Deleted:      proc.Deleted,
-			}
+			services[ipc.ServiceName(proc.Name)] = ipcService(proc)
 		} else {
 			return nil
 		}
@@ -187,3 +213,136 @@ func returnStatus(req *ipc.AskStatus) (services map[ipc.ServiceName]*ipc.Service
 
 	return services
 }
+
+func returnLogs(req *ipc.AskLogs) *ipc.AnswerLogs {
+	answer := &ipc.AnswerLogs{After: make(map[string]uint64)}
+
+	names := make([]ServiceName, 0, len(req.Names))
+	LoadedServicesMu.RLock()
+	for _, name := range req.Names {
+		if _, exists := LoadedServices[ServiceName(name)]; !exists {
+			LoadedServicesMu.RUnlock()
+			answer.Err = true
+			answer.ErrStr = fmt.Sprintf("no service matching '%s'", name)
+			return answer
+		}
+		names = append(names, ServiceName(name))
+	}
+	if len(names) == 0 {
+		for name, s := range LoadedServices {
+			if s.IsService() {
+				names = append(names, name)
+			}
+		}
+	}
+	LoadedServicesMu.RUnlock()
+
+	var since time.Time
+	if req.Since > 0 {
+		since = time.Unix(req.Since, 0)
+	}
+
+	for _, name := range names {
+		after, following := req.After[string(name)]
+		answer.After[string(name)] = after
+
+		// Even without output since the boot, its files may have some
+		l := getServiceLog(name)
+		lines := l.Lines(after, since, req.Lines)
+
+		// Only the last lines are kept, the older ones are read back from the files
+		if !following && (req.Lines <= 0 || len(lines) < req.Lines) && !l.keptSince(since) {
+			lines = append(l.OlderLines(since, req.Lines-len(lines)), lines...)
+		}
+
+		for _, line := range lines {
+			answer.Lines = append(answer.Lines, ipc.LogLine{
+				Service: string(name),
+				Seq:     line.Seq,
+				Time:    line.Time.UTC().UnixNano(),
+				Text:    line.Text,
+			})
+			// The lines from the files have none
+			if line.Seq > answer.After[string(name)] {
+				answer.After[string(name)] = line.Seq
+			}
+		}
+	}
+
+	sort.SliceStable(answer.Lines, func(i, j int) bool {
+		return answer.Lines[i].Time < answer.Lines[j].Time
+	})
+	// The last lines of all of them
+	if req.Lines > 0 && len(answer.Lines) > req.Lines {
+		answer.Lines = answer.Lines[len(answer.Lines)-req.Lines:]
+	}
+
+	return answer
+}
+
+// ipcService converts a Service to what lutractl knows about
+func ipcService(s *Service) *ipc.Service {
+	var tail []string
+	if s.State == Errored || s.State == Stopped {
+		tail = serviceLogTail(s.Name, statusTailLines)
+	}
+
+	runUser, runGroup, credErr := s.runAs()
+
+	is := &ipc.Service{
+		Name:         ipc.ServiceName(s.Name),
+		Type:         s.Type,
+		Description:  s.Description,
+		State:        ipc.RunState(s.State),
+		LastKnownPID: s.LastKnownPID,
+		LastAction:   ipc.LastAction(s.LastAction),
+		LastActionAt: s.LastActionAt,
+		LastMessage:  s.LastMessage,
+		Restart:      s.Restart,
+		RestartCount: s.RestartCount,
+		KilledBy:     s.KilledBy,
+		User:         runUser,
+		Group:        runGroup,
+		Usage:        serviceUsage(s),
+		LogTail:      tail,
+		Deleted:      s.Deleted,
+
+		Triggers: string(s.SocketService),
+		Accept:   s.Accept,
+	}
+	if credErr != nil {
+		is.CredentialErr = credErr.Error()
+	}
+	if s.IsTimer() {
+		is.Triggers = string(s.TimerService)
+		is.LastTrigger = unixOrZero(s.LastTrigger)
+		is.NextElapse = unixOrZero(s.NextElapse)
+	}
+	if s.Accept {
+		is.Connections = socketConnections(s.Name)
+	}
+	if s.hasDevice() {
+		is.Devices = s.deviceStatus()
+	}
+	if s.IsPath() {
+		is.Triggers = string(s.PathService)
+		for _, w := range s.PathWatches {
+			is.Watches = append(is.Watches, w.String())
+		}
+	}
+	if s.IsSocket() {
+		for _, l := range s.Listen {
+			is.Listen = append(is.Listen, l.String())
+		}
+	} else {
+		is.CapabilityBoundingSet = boundingSet(s)
+	}
+	return is
+}
+
+func unixOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UTC().Unix()
+}
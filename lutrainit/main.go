@@ -40,6 +40,9 @@ var (
 	//ShuttingDown is used to break various check loops like in getty
 	ShuttingDown bool
 
+	// startTime is when lutrainit started, its uptime
+	startTime = time.Now()
+
 	lsFnameSerialized = "/run/lutrainit.reexec.ls.bin"
 	glFnameSerialized = "/run/lutrainit.reexec.gl.bin"
 
@@ -60,6 +63,7 @@ func main() {
 		CmdServicesTree,
 		CmdServicesList,
 		CmdSysinit,
+		CmdExecService,
 	}
 	app.Flags = append(app.Flags, []cli.Flag{}...)
 
@@ -2,8 +2,11 @@ package main
 
 import (
 	"github.com/go-clog/clog"
+	"io/ioutil"
 	"os"
+	"strconv"
 	"strings"
+	"syscall"
 )
 
 // Remount a filesystem. Grub mounts / as ro during the boot process, and this will get it to
@@ -49,3 +52,60 @@ func UnmountAllExcept(except []string) {
 		clog.Error(2, err.Error())
 	}
 }
+
+// Mount flags kept on a read-only remount, statfs returns them with the same values
+const keptMountFlags = syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC | syscall.MS_NOATIME |
+	syscall.MS_NODIRATIME | syscall.MS_RELATIME
+
+// MountPoints returns the mount points of the calling process, from /proc/self/mountinfo
+func MountPoints() ([]string, error) {
+	content, err := ioutil.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+
+	var points []string
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 5 {
+			continue
+		}
+		points = append(points, unescapeMountPath(fields[4]))
+	}
+	return points, nil
+}
+
+// unescapeMountPath decodes the \040 octal escapes of spaces and the like
+func unescapeMountPath(path string) string {
+	if !strings.Contains(path, `\`) {
+		return path
+	}
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+3 < len(path) {
+			if c, err := strconv.ParseUint(path[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(path[i])
+	}
+	return b.String()
+}
+
+// BindMount src on dst, with all the mounts under src
+func BindMount(src, dst string) error {
+	return syscall.Mount(src, dst, "", syscall.MS_BIND|syscall.MS_REC, "")
+}
+
+// RemountReadOnly makes the mount point dir read-only, keeping its other flags.
+// In a mount namespace, only the copy of the namespace is changed.
+func RemountReadOnly(dir string) error {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return err
+	}
+	flags := uintptr(st.Flags)&keptMountFlags | syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY
+	return syscall.Mount("", dir, "", flags, "")
+}
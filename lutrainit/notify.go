@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"github.com/go-clog/clog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// notifySocketDir is where the NOTIFY_SOCKET of notify services are created
+const notifySocketDir = "/run/lutrainit/notify"
+
+// listenNotify creates the datagram socket given to the service in NOTIFY_SOCKET,
+// only root and the User of the service can write to it
+func listenNotify(s Service) (*net.UnixConn, error) {
+	cred, err := s.credential()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(notifySocketDir, 0755); err != nil {
+		return nil, err
+	}
+
+	path := fmt.Sprintf("%s/%s", notifySocketDir, s.Name)
+	// Left by a previous run of the service
+	os.Remove(path)
+
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+
+	// The sender of each message is checked
+	if err := passCredentials(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if err := os.Chmod(path, 0600); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if cred != nil {
+		if err := os.Chown(path, int(cred.Uid), int(cred.Gid)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
+
+// ownsProcess tells if p is pid, the main process of the service, or another of its processes
+func (s Service) ownsProcess(pid, p int) bool {
+	if p == pid {
+		return true
+	}
+	pids, err := cgroupProcs(s.Name)
+	if err != nil {
+		pids = processDescendants(pid)
+	}
+	for _, other := range pids {
+		if other == p {
+			return true
+		}
+	}
+	return false
+}
+
+// readNotify handles the notifications sent by the service until its socket is closed.
+// The service is killed if it doesn't send READY=1 before its TimeoutStart.
+// The messages of the processes which aren't the ones of the service are dropped.
+func (s Service) readNotify(conn *net.UnixConn, pid int) {
+	ready := false
+	conn.SetReadDeadline(time.Now().Add(s.TimeoutStart))
+
+	buf := make([]byte, 4096)
+	for {
+		n, sender, err := readCredentials(conn, buf)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() && !ready {
+				clog.Error(2, "[lutra] Service %s not ready after %s, killing it", s.Name, s.TimeoutStart)
+				LoadedServicesMu.Lock()
+				LoadedServices[s.Name].LastActionAt = time.Now().UTC().Unix()
+				LoadedServices[s.Name].LastAction = Forcekill
+				LoadedServices[s.Name].LastMessage = fmt.Sprintf("no READY=1 after %s", s.TimeoutStart)
+				LoadedServicesMu.Unlock()
+
+				sig, _ := killService(&s, pid)
+				LoadedServicesMu.Lock()
+				LoadedServices[s.Name].KilledBy = signalName(sig)
+				LoadedServicesMu.Unlock()
+			}
+			// Closed once the process exited
+			return
+		}
+		if !s.ownsProcess(pid, sender) {
+			clog.Warn("[lutra] Dropped a notification to %s from PID %d, not one of its processes", s.Name, sender)
+			continue
+		}
+
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			kv := strings.SplitN(line, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+
+			switch kv[0] {
+			case "READY":
+				if kv[1] != "1" || ready {
+					continue
+				}
+				ready = true
+				conn.SetReadDeadline(time.Time{})
+
+				LoadedServicesMu.Lock()
+				if LoadedServices[s.Name].State == Starting {
+					setState(s.Name, Started)
+					LoadedServices[s.Name].LastActionAt = time.Now().UTC().Unix()
+					LoadedServices[s.Name].LastAction = Start
+				}
+				LoadedServicesMu.Unlock()
+				clog.Info("[lutra] Started service %s", s.Name)
+			case "STATUS":
+				LoadedServicesMu.Lock()
+				LoadedServices[s.Name].LastMessage = kv[1]
+				LoadedServicesMu.Unlock()
+			case "MAINPID":
+				mainPID, err := strconv.Atoi(kv[1])
+				if err != nil || mainPID < 2 {
+					clog.Warn("[lutra] Service %s sent an invalid MAINPID: %s", s.Name, kv[1])
+					continue
+				}
+				// The service only knows its PID in its namespace
+				if s.PrivatePID {
+					if mainPID = hostPID(pid, mainPID); mainPID == 0 {
+						clog.Warn("[lutra] Service %s sent an unknown MAINPID: %s", s.Name, kv[1])
+						continue
+					}
+				}
+				if !s.ownsProcess(pid, mainPID) {
+					clog.Warn("[lutra] Service %s sent the MAINPID %s, not one of its processes", s.Name, kv[1])
+					continue
+				}
+				pid = mainPID
+				LoadedServicesMu.Lock()
+				LoadedServices[s.Name].LastKnownPID = mainPID
+				LoadedServicesMu.Unlock()
+			}
+		}
+	}
+}
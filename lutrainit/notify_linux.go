@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// passCredentials makes the kernel attach the credentials of the sender to each message
+func passCredentials(conn *net.UnixConn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_PASSCRED, 1)
+	}); err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// readCredentials reads a message into buf, with the PID of its sender, 0 if it's unknown
+func readCredentials(conn *net.UnixConn, buf []byte) (n, pid int, err error) {
+	oob := make([]byte, syscall.CmsgSpace(syscall.SizeofUcred))
+	n, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	msgs, _ := syscall.ParseSocketControlMessage(oob[:oobn])
+	for _, msg := range msgs {
+		if ucred, err := syscall.ParseUnixCredentials(&msg); err == nil {
+			return n, int(ucred.Pid), nil
+		}
+	}
+	return n, 0, nil
+}
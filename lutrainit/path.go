@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"github.com/go-clog/clog"
+	"github.com/go-ini/ini"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Kinds of PathWatch of the path units
+const (
+	PathExists        = "PathExists"
+	PathChanged       = "PathChanged"
+	PathModified      = "PathModified"
+	DirectoryNotEmpty = "DirectoryNotEmpty"
+)
+
+// PathWatch is a path watched by a path unit.
+// PathExists and DirectoryNotEmpty fire as long as they hold, PathChanged and PathModified on
+// a change only.
+type PathWatch struct {
+	Kind string
+	Path string
+}
+
+func (w PathWatch) String() string {
+	return fmt.Sprintf("%s %s", w.Kind, w.Path)
+}
+
+// IsPath or not
+func (s Service) IsPath() bool {
+	return strings.HasSuffix(string(s.Name), ".path")
+}
+
+// edge if it fires on a change of the path, not on its state
+func (w PathWatch) edge() bool {
+	return w.Kind == PathChanged || w.Kind == PathModified
+}
+
+// holds if the condition of a PathExists or DirectoryNotEmpty is true now
+func (w PathWatch) holds() bool {
+	switch w.Kind {
+	case PathExists:
+		_, err := os.Stat(w.Path)
+		return err == nil
+	case DirectoryNotEmpty:
+		d, err := os.Open(w.Path)
+		if err != nil {
+			return false
+		}
+		defer d.Close()
+		names, _ := d.Readdirnames(1)
+		return len(names) > 0
+	}
+	return false
+}
+
+// parsePathUnit parses the [path] section of a .path file
+func parsePathUnit(s Service, cfg *ini.File, fname string) (Service, error) {
+	sec, err := cfg.GetSection("path")
+	if err != nil {
+		clog.Error(2, "path %s does not contains a path section", fname)
+		return s, fmt.Errorf("path %s does not contains a path section", fname)
+	}
+
+	s.Type = "path"
+	s.Description = sec.Key("Description").MustString("")
+	s.AutoStart = sec.Key("Autostart").MustBool(true)
+
+	for _, kind := range []string{PathExists, PathChanged, PathModified, DirectoryNotEmpty} {
+		for _, path := range sec.Key(kind).ValueWithShadows() {
+			if path == "" {
+				continue
+			}
+			if !filepath.IsAbs(path) || filepath.Clean(path) == "/" {
+				clog.Error(2, "path %s invalid %s: %s must be an absolute path", fname, kind, path)
+				return s, fmt.Errorf("path %s invalid %s: %s must be an absolute path", fname, kind, path)
+			}
+			s.PathWatches = append(s.PathWatches, PathWatch{Kind: kind, Path: filepath.Clean(path)})
+		}
+	}
+	if len(s.PathWatches) == 0 {
+		return s, fmt.Errorf("path %s does not watch any path", fname)
+	}
+
+	s.MakeDirectory = sec.Key("MakeDirectory").MustBool(false)
+	mode, err := strconv.ParseUint(sec.Key("DirectoryMode").MustString("0755"), 8, 32)
+	if err != nil || mode > 0777 {
+		clog.Error(2, "path %s invalid DirectoryMode: %s", fname, sec.Key("DirectoryMode").String())
+		return s, fmt.Errorf("path %s invalid DirectoryMode: %s", fname, sec.Key("DirectoryMode").String())
+	}
+	s.DirectoryMode = os.FileMode(mode)
+
+	base := strings.TrimSuffix(string(s.Name), ".path")
+	s.PathService = ServiceName(sec.Key("Unit").MustString(base + ".service"))
+
+	return s, nil
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"fmt"
+	"github.com/go-clog/clog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// inotify events of a watched path, and of the directory it is created in
+const (
+	pathSelfEvents    = syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF
+	pathChangedEvents = pathSelfEvents | syscall.IN_ATTRIB | syscall.IN_CLOSE_WRITE | syscall.IN_CREATE |
+		syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO
+	pathParentEvents = pathSelfEvents | syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO
+)
+
+// pathStops are the pipes waking up the watchers of the path units, to stop them
+var (
+	pathStops   = make(map[ServiceName]*os.File)
+	pathStopsMu sync.Mutex
+)
+
+// events of w to watch on its path
+func (w PathWatch) events() uint32 {
+	switch w.Kind {
+	case PathChanged:
+		return pathChangedEvents
+	case PathModified:
+		return pathChangedEvents | syscall.IN_MODIFY
+	case DirectoryNotEmpty:
+		return pathSelfEvents | syscall.IN_CREATE | syscall.IN_MOVED_TO
+	}
+	return pathSelfEvents
+}
+
+// pathTarget is what an inotify watch is for: the path of watch itself, or its closest existing
+// directory, where child would be created
+type pathTarget struct {
+	watch  *PathWatch
+	child  string
+	direct bool // the directory is the one of the path
+}
+
+// startWatching watches the paths of the path unit s
+func startWatching(s *Service) error {
+	LoadedServicesMu.Lock()
+	if s.State == Started {
+		LoadedServicesMu.Unlock()
+		return fmt.Errorf("path %s is already watching", s.Name)
+	}
+	LoadedServices[s.Name].LastActionAt = time.Now().UTC().Unix()
+	LoadedServices[s.Name].LastAction = Start
+	LoadedServicesMu.Unlock()
+
+	if s.MakeDirectory {
+		for _, w := range s.PathWatches {
+			if w.Kind == PathExists {
+				continue
+			}
+			if err := os.MkdirAll(w.Path, s.DirectoryMode); err != nil {
+				clog.Error(2, "[lutra] Cannot create %s for %s: %s", w.Path, s.Name, err.Error())
+				LoadedServicesMu.Lock()
+				setState(s.Name, Errored)
+				LoadedServices[s.Name].LastMessage = fmt.Sprintf("cannot create %s: %s", w.Path, err.Error())
+				LoadedServicesMu.Unlock()
+				return fmt.Errorf("cannot create %s: %s", w.Path, err.Error())
+			}
+		}
+	}
+
+	// Started before the watcher runs, else it would stop on the first trigger
+	LoadedServicesMu.Lock()
+	LoadedServices[s.Name].TriggerTimes = nil
+	LoadedServices[s.Name].LastMessage = ""
+	setState(s.Name, Started)
+	LoadedServicesMu.Unlock()
+
+	if err := watchPaths(s.Name); err != nil {
+		LoadedServicesMu.Lock()
+		setState(s.Name, Errored)
+		LoadedServices[s.Name].LastMessage = err.Error()
+		LoadedServicesMu.Unlock()
+		return err
+	}
+
+	clog.Info("[lutra] Path %s watching for %s", s.Name, s.PathService)
+	return nil
+}
+
+// stopWatching stops the watcher of the path unit s, its service keeps running
+func stopWatching(s *Service) error {
+	stopPathWatcher(s.Name)
+
+	LoadedServicesMu.Lock()
+	defer LoadedServicesMu.Unlock()
+	LoadedServices[s.Name].LastActionAt = time.Now().UTC().Unix()
+	LoadedServices[s.Name].LastAction = Stop
+	setState(s.Name, Stopped)
+	clog.Info("Path %s stopped", s.Name)
+	return nil
+}
+
+func stopPathWatcher(name ServiceName) {
+	pathStopsMu.Lock()
+	stop, ok := pathStops[name]
+	delete(pathStops, name)
+	pathStopsMu.Unlock()
+	if ok {
+		stop.Write([]byte{0})
+		stop.Close()
+	}
+}
+
+// restorePaths watches again the paths of the path units started before a reexec
+func restorePaths() {
+	LoadedServicesMu.RLock()
+	var names []ServiceName
+	for name, s := range LoadedServices {
+		if s.IsPath() && s.State == Started {
+			names = append(names, name)
+		}
+	}
+	LoadedServicesMu.RUnlock()
+
+	for _, name := range names {
+		if err := watchPaths(name); err != nil {
+			clog.Error(2, "[lutra] Cannot watch path %s again: %s", name, err.Error())
+		}
+	}
+}
+
+// watchPaths starts the watcher of the path unit name, it runs until stopPathWatcher
+func watchPaths(name ServiceName) error {
+	stopR, stopW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	pathStopsMu.Lock()
+	pathStops[name] = stopW
+	pathStopsMu.Unlock()
+
+	go func() {
+		defer stopR.Close()
+		for {
+			// Read each time, a reload may have changed them
+			LoadedServicesMu.RLock()
+			watches := LoadedServices[name].PathWatches
+			LoadedServicesMu.RUnlock()
+
+			fired, err := waitPaths(watches, stopR)
+			if err != nil {
+				LoadedServicesMu.Lock()
+				failPath(LoadedServices[name], fmt.Sprintf("cannot watch: %s", err.Error()))
+				LoadedServicesMu.Unlock()
+				return
+			}
+			if fired == nil || !activatePath(name, *fired) {
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// waitPaths returns the first of watches to fire, or nil once stop is written to.
+// The paths are not watched while the service runs, like the sockets.
+func waitPaths(watches []PathWatch, stop *os.File) (*PathWatch, error) {
+	for {
+		ifd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+		if err != nil {
+			return nil, err
+		}
+		fired, again, err := waitInotify(ifd, watches, stop)
+		syscall.Close(ifd)
+		if err != nil || !again {
+			return fired, err
+		}
+	}
+}
+
+// waitInotify watches the paths with ifd, again when they must be watched again as one of them
+// or of their directories appeared or disappeared
+func waitInotify(ifd int, watches []PathWatch, stop *os.File) (fired *PathWatch, again bool, err error) {
+	targets := make(map[int32][]pathTarget)
+	for i := range watches {
+		w := &watches[i]
+		// The same inode has a single watch, the events of all its targets are added
+		if wd, err := syscall.InotifyAddWatch(ifd, w.Path, w.events()|syscall.IN_MASK_ADD); err == nil {
+			targets[int32(wd)] = append(targets[int32(wd)], pathTarget{watch: w})
+		}
+		dir, child := existingParent(w.Path)
+		wd, err := syscall.InotifyAddWatch(ifd, dir, pathParentEvents|syscall.IN_MASK_ADD)
+		if err != nil {
+			return nil, false, fmt.Errorf("%s: %s", dir, err.Error())
+		}
+		targets[int32(wd)] = append(targets[int32(wd)], pathTarget{watch: w, child: child, direct: dir == filepath.Dir(w.Path)})
+	}
+
+	// Once watched, not to miss a change in between
+	for i := range watches {
+		if watches[i].holds() {
+			return &watches[i], false, nil
+		}
+	}
+
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, false, err
+	}
+	defer syscall.Close(epfd)
+	stopFd := int(stop.Fd())
+	for _, fd := range []int{stopFd, ifd} {
+		if err := syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, fd, &syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(fd)}); err != nil {
+			return nil, false, err
+		}
+	}
+
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	events := make([]syscall.EpollEvent, 2)
+	for {
+		n, err := syscall.EpollWait(epfd, events, -1)
+		if err == syscall.EINTR {
+			continue
+		} else if err != nil {
+			return nil, false, err
+		}
+		for _, ev := range events[:n] {
+			if int(ev.Fd) == stopFd {
+				return nil, false, nil
+			}
+		}
+
+		n, err = syscall.Read(ifd, buf)
+		if err == syscall.EINTR {
+			continue
+		} else if err != nil {
+			return nil, false, err
+		}
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			nameStart := off + syscall.SizeofInotifyEvent
+			name := strings.TrimRight(string(buf[nameStart:nameStart+int(ev.Len)]), "\x00")
+			off = nameStart + int(ev.Len)
+
+			if ev.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				again = true
+				continue
+			}
+			for _, t := range targets[ev.Wd] {
+				if fire, rewatch := t.fires(ev.Mask, name); fire {
+					return t.watch, false, nil
+				} else if rewatch {
+					again = true
+				}
+			}
+		}
+		if again {
+			return nil, true, nil
+		}
+	}
+}
+
+// fires tells if an event of mask, about the file name in a watched directory, fires the watch
+// of t, or if the paths must be watched again
+func (t pathTarget) fires(mask uint32, name string) (fire bool, rewatch bool) {
+	gone := mask&(pathSelfEvents|syscall.IN_IGNORED) != 0
+	if t.child != "" {
+		if name == "" {
+			return false, gone
+		}
+		if name != t.child || mask&pathParentEvents == 0 {
+			return false, false
+		}
+		// Created, deleted or moved
+		return t.direct && t.watch.edge(), true
+	}
+
+	switch {
+	case gone:
+		return t.watch.edge(), true
+	case t.watch.edge():
+		return mask&t.watch.events() != 0, false
+	case t.watch.Kind == DirectoryNotEmpty:
+		return t.watch.holds(), false
+	}
+	return false, false
+}
+
+// existingParent returns the closest existing directory of path, and its child on the way to path
+func existingParent(path string) (dir, child string) {
+	dir, child = filepath.Dir(path), filepath.Base(path)
+	for dir != "/" {
+		if fi, err := os.Stat(dir); err == nil && fi.IsDir() {
+			break
+		}
+		dir, child = filepath.Dir(dir), filepath.Base(dir)
+	}
+	return dir, child
+}
+
+// activatePath starts the service of the path unit name as w fired, and waits until it isn't
+// running anymore, to watch the paths again. It returns false when the path unit isn't watching
+// anymore.
+func activatePath(name ServiceName, w PathWatch) bool {
+	LoadedServicesMu.Lock()
+	defer LoadedServicesMu.Unlock()
+
+	unit := LoadedServices[name]
+	if unit.State != Started || ShuttingDown {
+		return false
+	}
+	s, ok := LoadedServices[unit.PathService]
+	if !ok {
+		failPath(unit, fmt.Sprintf("service %s doesn't exist", unit.PathService))
+		return false
+	}
+
+	// A oneshot done is started again
+	if !s.running() {
+		if tooManyTriggers(unit) {
+			failPath(unit, fmt.Sprintf("triggered %s more than %d times in %s", s.Name, triggerBurst, triggerInterval))
+			return false
+		}
+
+		clog.Info("[lutra] %s for path %s, starting %s", w.String(), name, s.Name)
+		launch(s)
+	}
+
+	for unit.State == Started && s.running() {
+		serviceStateChanged.Wait()
+	}
+	return unit.State == Started
+}
+
+// failPath puts the path unit in error and stops its watcher, LoadedServicesMu must be held
+func failPath(unit *Service, reason string) {
+	clog.Error(2, "[lutra] Path %s failed: %s", unit.Name, reason)
+	setState(unit.Name, Errored)
+	unit.LastMessage = reason
+	stopPathWatcher(unit.Name)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// processZombie is never known, there is no /proc
+func processZombie(pid int) bool {
+	return false
+}
+
+// processDescendants isn't available without /proc
+func processDescendants(pid int) []int {
+	return nil
+}
+
+// joinCgroup does nothing, there are no cgroups
+func (s Service) joinCgroup(cmd *exec.Cmd) error {
+	return nil
+}
+
+// cgroupProcs always fails, there are no cgroups
+func cgroupProcs(name ServiceName) ([]int, error) {
+	return nil, fmt.Errorf("cgroups not available")
+}
+
+// rlimInfinity is RLIM_INFINITY
+const rlimInfinity = uint64(1<<63 - 1)
+
+// rlimitResources are the Limit* directives known by darwin
+var rlimitResources = map[string]int{
+	"CPU":    syscall.RLIMIT_CPU,
+	"FSIZE":  syscall.RLIMIT_FSIZE,
+	"DATA":   syscall.RLIMIT_DATA,
+	"STACK":  syscall.RLIMIT_STACK,
+	"CORE":   syscall.RLIMIT_CORE,
+	"NOFILE": syscall.RLIMIT_NOFILE,
+	"AS":     syscall.RLIMIT_AS,
+}
+
+func setRlimit(l Rlimit) error {
+	return syscall.Setrlimit(l.Resource, &syscall.Rlimit{Cur: l.Cur, Max: l.Max})
+}
+
+// apply fails if anything is set, there is no scheduling support here
+func (sc Scheduling) apply() error {
+	if sc.IsSet() {
+		return fmt.Errorf("scheduling settings are not supported")
+	}
+	return nil
+}
+
+// setNamespaces does nothing, there are no namespaces
+func (s Service) setNamespaces(cmd *exec.Cmd) {}
+
+// apply fails if anything is set, there are no mount namespaces here
+func (sb Sandbox) apply(name ServiceName) error {
+	if sb.IsSet() {
+		return fmt.Errorf("sandboxing settings are not supported")
+	}
+	return nil
+}
+
+// passCredentials fails, the sender of a datagram isn't known here
+func passCredentials(conn *net.UnixConn) error {
+	return fmt.Errorf("notify services are not supported")
+}
+
+// readCredentials is never used, passCredentials fails
+func readCredentials(conn *net.UnixConn, buf []byte) (n, pid int, err error) {
+	return 0, 0, fmt.Errorf("notify services are not supported")
+}
+
+// hostPID returns nsPID, there are no PID namespaces
+func hostPID(pid, nsPID int) int {
+	return nsPID
+}
+
+// limit fails if anything is set, there are no capabilities here
+func (c Capabilities) limit() error {
+	if c.IsSet() {
+		return fmt.Errorf("capabilities settings are not supported")
+	}
+	return nil
+}
+
+// raise does nothing, limit already failed
+func (c Capabilities) raise() error {
+	return nil
+}
+
+// systemCallNumbers is empty, there is no seccomp
+var systemCallNumbers = map[string]uint32{}
+
+// install fails if a filter is set, there is no seccomp here
+func (sc Seccomp) install() error {
+	if sc.IsSet() {
+		return fmt.Errorf("SystemCallFilter is not supported")
+	}
+	return nil
+}
+
+// startListening fails, socket units are not supported here
+func startListening(s *Service) error {
+	return fmt.Errorf("socket units are not supported")
+}
+
+// stopListening does nothing, nothing listens
+func stopListening(s *Service) error {
+	return nil
+}
+
+// socketFiles returns nothing, nothing listens
+func socketFiles(name ServiceName) (files []*os.File, names []string) {
+	return nil, nil
+}
+
+// startWatching fails, path units are not supported here
+func startWatching(s *Service) error {
+	return fmt.Errorf("path units are not supported")
+}
+
+// stopWatching does nothing, nothing is watched
+func stopWatching(s *Service) error {
+	return nil
+}
+
+// bootTime is when lutrainit started, close enough here
+func bootTime() time.Time {
+	return startTime
+}
@@ -1,12 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/go-clog/clog"
 	"github.com/mitchellh/go-ps"
 	"io/ioutil"
 	"os"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 )
@@ -115,6 +117,56 @@ func getAllProcesses() ([]*os.Process, error) {
 	return rprocs, nil
 }
 
+// processZombie tells if pid exited and waits to be reaped
+func processZombie(pid int) bool {
+	stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return false
+	}
+	// The state is the first field after the command name
+	fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+	return len(fields) > 0 && fields[0] == "Z"
+}
+
+// processDescendants returns the PIDs of all the children of pid, and their children, and so on
+func processDescendants(pid int) []int {
+	procs, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+
+	children := make(map[int][]int)
+	for _, f := range procs {
+		child, err := strconv.Atoi(f.Name())
+		if err != nil {
+			continue
+		}
+		stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", child))
+		if err != nil {
+			continue
+		}
+		// The command name is between parenthesis and may contain spaces, the PPID is the
+		// second field after it
+		fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+		if len(fields) < 2 {
+			continue
+		}
+		ppid, err := strconv.Atoi(fields[1])
+		if err != nil {
+			continue
+		}
+		children[ppid] = append(children[ppid], child)
+	}
+
+	descendants := make([]int, 0)
+	queue := children[pid]
+	for len(queue) > 0 {
+		descendants = append(descendants, queue[0])
+		queue = append(queue[1:], children[queue[0]]...)
+	}
+	return descendants
+}
+
 func doShutdown(reboot bool) {
 	ShuttingDown = true
 
@@ -125,12 +177,13 @@ func doShutdown(reboot bool) {
 	}
 
 	clog.Info("Shutdown or reboot initiated, please wait...")
-	// TODO: Run shutdown scripts for services that are started instead
-	// of just sending them a SIGTERM right off the bat..
+	// Cleanly stop the services first, KillAll is only there for what is left
+	StopServices()
 	KillAll()
 
 	// At this point we need to remove the file logger
 	clog.Delete(clog.FILE)
+	stopServiceLogFiles()
 
 	// This needs to be done after all the processes are dead, otherwise
 	// it will fail due to being in use.
@@ -145,3 +198,31 @@ func doShutdown(reboot bool) {
 		syscall.Reboot(syscall.LINUX_REBOOT_CMD_POWER_OFF)
 	}
 }
+
+// hostPID returns the PID on the host of the process nsPID in the PID namespace whose first
+// process is pid, 0 if there is none
+func hostPID(pid, nsPID int) int {
+	for _, p := range append([]int{pid}, processDescendants(pid)...) {
+		status, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/status", p))
+		if err != nil {
+			continue
+		}
+		// NSpid: <host pid> ... <pid in the innermost namespace>
+		for _, line := range strings.Split(string(status), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) > 1 && fields[0] == "NSpid:" && fields[len(fields)-1] == strconv.Itoa(nsPID) {
+				return p
+			}
+		}
+	}
+	return 0
+}
+
+// bootTime is when the system booted, from its uptime
+func bootTime() time.Time {
+	var info syscall.Sysinfo_t
+	if err := syscall.Sysinfo(&info); err != nil {
+		return startTime
+	}
+	return time.Now().Add(-time.Duration(info.Uptime) * time.Second)
+}
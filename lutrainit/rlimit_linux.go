@@ -0,0 +1,33 @@
+package main
+
+import (
+	"syscall"
+)
+
+// rlimInfinity is RLIM_INFINITY
+const rlimInfinity = ^uint64(0)
+
+// rlimitResources are the Limit* directives, LimitNOFILE sets RLIMIT_NOFILE.
+// syscall lacks some of them, their numbers depend on the architecture.
+var rlimitResources = map[string]int{
+	"CPU":        syscall.RLIMIT_CPU,
+	"FSIZE":      syscall.RLIMIT_FSIZE,
+	"DATA":       syscall.RLIMIT_DATA,
+	"STACK":      syscall.RLIMIT_STACK,
+	"CORE":       syscall.RLIMIT_CORE,
+	"RSS":        rlimitRSS,
+	"NPROC":      rlimitNPROC,
+	"NOFILE":     syscall.RLIMIT_NOFILE,
+	"MEMLOCK":    rlimitMEMLOCK,
+	"AS":         syscall.RLIMIT_AS,
+	"LOCKS":      10,
+	"SIGPENDING": 11,
+	"MSGQUEUE":   12,
+	"NICE":       13,
+	"RTPRIO":     14,
+	"RTTIME":     15,
+}
+
+func setRlimit(l Rlimit) error {
+	return syscall.Setrlimit(l.Resource, &syscall.Rlimit{Cur: l.Cur, Max: l.Max})
+}
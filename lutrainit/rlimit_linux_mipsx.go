@@ -0,0 +1,11 @@
+//go:build mips || mipsle || mips64 || mips64le
+// +build mips mipsle mips64 mips64le
+
+package main
+
+// Numbers of the resources of mips, from arch/mips/include/uapi/asm/resource.h of linux
+const (
+	rlimitRSS     = 7
+	rlimitNPROC   = 8
+	rlimitMEMLOCK = 9
+)
@@ -0,0 +1,8 @@
+package main
+
+// Numbers of the resources of sparc, from arch/sparc/include/uapi/asm/resource.h of linux
+const (
+	rlimitRSS     = 5
+	rlimitNPROC   = 7
+	rlimitMEMLOCK = 8
+)
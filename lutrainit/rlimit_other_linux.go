@@ -0,0 +1,11 @@
+//go:build !mips && !mipsle && !mips64 && !mips64le && !sparc64
+// +build !mips,!mipsle,!mips64,!mips64le,!sparc64
+
+package main
+
+// Numbers of the asm-generic resources, used by most architectures
+const (
+	rlimitRSS     = 5
+	rlimitNPROC   = 6
+	rlimitMEMLOCK = 8
+)
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/go-ini/ini"
+)
+
+func TestParseRlimit(t *testing.T) {
+	tests := []struct {
+		val      string
+		cur, max uint64
+	}{
+		{"1024", 1024, 1024},
+		{"1024:4096", 1024, 4096},
+		{" 1024 : 4096 ", 1024, 4096},
+		{"infinity", rlimInfinity, rlimInfinity},
+		{"max:max", rlimInfinity, rlimInfinity},
+		{"512:infinity", 512, rlimInfinity},
+		{"0", 0, 0},
+		{"1K", 1 << 10, 1 << 10},
+		{"4m:8M", 4 << 20, 8 << 20},
+		{"2G", 2 << 30, 2 << 30},
+		{"16777215T", 16777215 << 40, 16777215 << 40},
+	}
+	for _, test := range tests {
+		l, err := parseRlimit(syscall.RLIMIT_NOFILE, test.val)
+		if err != nil {
+			t.Errorf("%q: %s", test.val, err.Error())
+			continue
+		}
+		if l.Resource != syscall.RLIMIT_NOFILE || l.Cur != test.cur || l.Max != test.max {
+			t.Errorf("%q: got %+v, want %d:%d", test.val, l, test.cur, test.max)
+		}
+	}
+
+	for _, val := range []string{"4096:1024", "infinity:1024", "abc", ":5", "5:", "1x", "-1", "1.5K", "1:2:3", "99999999T", "18446744073709551616", "16777216T"} {
+		if l, err := parseRlimit(syscall.RLIMIT_NOFILE, val); err == nil {
+			t.Errorf("%q: no error, got %+v", val, l)
+		}
+	}
+}
+
+func TestRlimitResources(t *testing.T) {
+	if rlimitResources["NOFILE"] != syscall.RLIMIT_NOFILE || rlimitResources["CORE"] != syscall.RLIMIT_CORE {
+		t.Errorf("NOFILE and CORE are not the ones of syscall")
+	}
+	names := make(map[int]string)
+	for name, resource := range rlimitResources {
+		if other, ok := names[resource]; ok {
+			t.Errorf("%s and %s are both %d", name, other, resource)
+		}
+		names[resource] = name
+	}
+}
+
+func TestParseRlimits(t *testing.T) {
+	cfg, err := ini.InsensitiveLoad([]byte("[limits]\nLimitNOFILE=1024:4096\nLimitCORE=infinity\nLimitNice=\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	limits, err := parseRlimits(cfg.Section("limits"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(limits) != 2 {
+		t.Fatalf("got %+v, want NOFILE and CORE", limits)
+	}
+	for _, l := range limits {
+		switch l.Resource {
+		case syscall.RLIMIT_NOFILE:
+			if l.Cur != 1024 || l.Max != 4096 {
+				t.Errorf("NOFILE: got %+v", l)
+			}
+		case syscall.RLIMIT_CORE:
+			if l.Cur != rlimInfinity || l.Max != rlimInfinity {
+				t.Errorf("CORE: got %+v", l)
+			}
+		default:
+			t.Errorf("unexpected %+v", l)
+		}
+	}
+
+	cfg, err = ini.InsensitiveLoad([]byte("[limits]\nLimitNOFILE=lots\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseRlimits(cfg.Section("limits")); err == nil || err.Error() != "LimitNOFILE: lots is not a number" {
+		t.Errorf("got error %v", err)
+	}
+}
+
+func TestServiceRlimits(t *testing.T) {
+	saved := MainConfig.Rlimits
+	defer func() { MainConfig.Rlimits = saved }()
+
+	MainConfig.Rlimits = []Rlimit{
+		{Resource: syscall.RLIMIT_NOFILE, Cur: 1024, Max: 1024},
+		{Resource: syscall.RLIMIT_CORE, Cur: 0, Max: 0},
+	}
+	s := Service{Rlimits: []Rlimit{{Resource: syscall.RLIMIT_NOFILE, Cur: 4096, Max: 8192}}}
+
+	limits := s.rlimits()
+	if len(limits) != 2 {
+		t.Fatalf("got %+v", limits)
+	}
+	if limits[0] != (Rlimit{Resource: syscall.RLIMIT_NOFILE, Cur: 4096, Max: 8192}) {
+		t.Errorf("the service should override the NOFILE of lutra.conf, got %+v", limits[0])
+	}
+	if limits[1] != (Rlimit{Resource: syscall.RLIMIT_CORE}) {
+		t.Errorf("the CORE of lutra.conf should be kept, got %+v", limits[1])
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"github.com/go-clog/clog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Sandbox of the processes of a service, set up in namespaces of their own.
+// Paths prefixed by "-" are ignored when missing.
+type Sandbox struct {
+	PrivateNetwork bool // only a loopback interface
+	PrivateIPC     bool
+	PrivateUTS     bool
+	PrivatePID     bool // the command is the PID 1 of the namespace, with its own /proc
+
+	PrivateTmp    bool
+	ProtectSystem string // true, full or strict
+	ProtectHome   string // true, read-only or tmpfs
+
+	ReadOnlyPaths     []string
+	ReadWritePaths    []string
+	InaccessiblePaths []string
+	BindPaths         []string // source[:destination]
+}
+
+// IsSet if the service needs a namespace
+func (sb Sandbox) IsSet() bool {
+	return sb.PrivateNetwork || sb.PrivateIPC || sb.PrivateUTS || sb.mountNamespace()
+}
+
+// mountNamespace if the service needs a mount namespace, a private PID one needs its /proc
+func (sb Sandbox) mountNamespace() bool {
+	return sb.PrivatePID || sb.PrivateTmp || sb.ProtectSystem != "" || sb.ProtectHome != "" || len(sb.ReadOnlyPaths) > 0 ||
+		len(sb.ReadWritePaths) > 0 || len(sb.InaccessiblePaths) > 0 || len(sb.BindPaths) > 0
+}
+
+// protectSetting normalizes the yes/no values of ProtectSystem and ProtectHome, "" is no
+func protectSetting(val string, modes ...string) (string, error) {
+	switch strings.ToLower(val) {
+	case "", "no", "false", "0":
+		return "", nil
+	case "yes", "true", "1":
+		return "true", nil
+	}
+	for _, m := range modes {
+		if val == m {
+			return m, nil
+		}
+	}
+	return "", fmt.Errorf("unknown value %s, must be a boolean or %s", val, strings.Join(modes, ", "))
+}
+
+// check the paths, which must be absolute
+func (sb Sandbox) check() error {
+	lists := []struct {
+		name  string
+		paths []string
+	}{
+		{"ReadOnlyPaths", sb.ReadOnlyPaths},
+		{"ReadWritePaths", sb.ReadWritePaths},
+		{"InaccessiblePaths", sb.InaccessiblePaths},
+	}
+	for _, l := range lists {
+		for _, path := range l.paths {
+			if !filepath.IsAbs(strings.TrimPrefix(path, "-")) {
+				return fmt.Errorf("%s must be absolute: %s", l.name, path)
+			}
+		}
+	}
+
+	for _, bind := range sb.BindPaths {
+		src, dst := splitBindPath(bind)
+		if !filepath.IsAbs(src) || !filepath.IsAbs(dst) {
+			return fmt.Errorf("BindPaths must be absolute: %s", bind)
+		}
+	}
+	return nil
+}
+
+// splitBindPath returns the source and destination of a BindPaths entry, without its "-" prefix
+func splitBindPath(bind string) (src, dst string) {
+	parts := strings.SplitN(strings.TrimPrefix(bind, "-"), ":", 2)
+	if len(parts) == 1 {
+		return parts[0], parts[0]
+	}
+	return parts[0], parts[1]
+}
+
+// privateTmpRoot has the PrivateTmp directories of the services, only root can go in
+const privateTmpRoot = "/run/lutrainit/tmp"
+
+// privateTmpDir is where base, /tmp or /var/tmp, of a service with PrivateTmp lives on the host.
+// It is kept between its processes, so ExecStartPre and ExecStart share it.
+func privateTmpDir(base string, name ServiceName) string {
+	return filepath.Join(privateTmpRoot, string(name), strings.Replace(strings.Trim(base, "/"), "/", "-", -1))
+}
+
+// removePrivateTmp removes the PrivateTmp directories of the service once its processes are gone
+func (s Service) removePrivateTmp() {
+	if !s.PrivateTmp {
+		return
+	}
+	name := s.Name
+	if s.Instance != "" {
+		name = s.Instance
+	}
+	if err := os.RemoveAll(filepath.Join(privateTmpRoot, string(name))); err != nil {
+		clog.Warn("[lutra] Cannot remove PrivateTmp of %s: %s", name, err.Error())
+	}
+}
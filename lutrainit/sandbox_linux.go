@@ -0,0 +1,323 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	// protectSystemPaths are made read-only by ProtectSystem
+	protectSystemPaths = map[string][]string{
+		"true":   {"/usr", "/boot", "/efi"},
+		"full":   {"/usr", "/boot", "/efi", "/etc"},
+		"strict": {"/"},
+	}
+
+	// protectHomePaths are hidden or made read-only by ProtectHome
+	protectHomePaths = []string{"/home", "/root", "/run/user"}
+
+	// apiPaths stay writable with ProtectSystem=strict
+	apiPaths = []string{"/dev", "/proc", "/sys"}
+)
+
+// setNamespaces makes cmd start in the namespaces the service needs.
+// With a private PID namespace, cmd.Process.Pid is still the PID on the host.
+func (s Service) setNamespaces(cmd *exec.Cmd) {
+	flags := []struct {
+		set  bool
+		flag uintptr
+	}{
+		{s.Sandbox.mountNamespace(), syscall.CLONE_NEWNS},
+		{s.PrivateNetwork, syscall.CLONE_NEWNET},
+		{s.PrivateIPC, syscall.CLONE_NEWIPC},
+		{s.PrivateUTS, syscall.CLONE_NEWUTS},
+		{s.PrivatePID, syscall.CLONE_NEWPID},
+	}
+	for _, f := range flags {
+		if f.set {
+			cmd.SysProcAttr.Cloneflags |= f.flag
+		}
+	}
+}
+
+// apply the sandbox in the namespaces of the process, nothing is seen outside of them but
+// the PrivateTmp directories
+func (sb Sandbox) apply(name ServiceName) error {
+	if sb.PrivateNetwork {
+		if err := loopbackUp(); err != nil {
+			return fmt.Errorf("cannot bring up the loopback of PrivateNetwork: %s", err.Error())
+		}
+	}
+
+	// Never on the host mounts
+	if !sb.mountNamespace() {
+		return nil
+	}
+
+	// Mounts of the host still come in, ours don't go out
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_SLAVE, ""); err != nil {
+		return fmt.Errorf("cannot make / a slave mount: %s", err.Error())
+	}
+
+	if sb.PrivatePID {
+		flags := uintptr(syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC)
+		if err := syscall.Mount("proc", "/proc", "proc", flags, ""); err != nil {
+			return fmt.Errorf("cannot mount /proc of PrivatePID: %s", err.Error())
+		}
+	}
+
+	for _, bind := range sb.BindPaths {
+		src, dst := splitBindPath(bind)
+		srcOk, err := sandboxPathExists(bind, src)
+		if err != nil {
+			return err
+		}
+		dstOk, err := sandboxPathExists(bind, dst)
+		if err != nil {
+			return err
+		}
+		if !srcOk || !dstOk {
+			continue
+		}
+		if err := BindMount(src, dst); err != nil {
+			return fmt.Errorf("cannot bind %s on %s: %s", src, dst, err.Error())
+		}
+	}
+
+	var writable []string
+	if sb.PrivateTmp {
+		for _, base := range []string{"/tmp", "/var/tmp"} {
+			if _, err := os.Stat(base); err != nil {
+				continue
+			}
+			if err := privateTmp(base, name); err != nil {
+				return fmt.Errorf("cannot set up PrivateTmp on %s: %s", base, err.Error())
+			}
+			writable = append(writable, base)
+		}
+	}
+
+	// Own mount points, so they are not among the read-only ones
+	for _, path := range sb.ReadWritePaths {
+		if ok, err := sandboxPathExists(path, path); !ok {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		path = strings.TrimPrefix(path, "-")
+		if err := ensureMountPoint(path); err != nil {
+			return fmt.Errorf("cannot make %s writable: %s", path, err.Error())
+		}
+		writable = append(writable, path)
+	}
+
+	var readOnly, inaccessible []string
+	readOnly = append(readOnly, protectSystemPaths[sb.ProtectSystem]...)
+	switch sb.ProtectHome {
+	case "true":
+		inaccessible = append(inaccessible, protectHomePaths...)
+	case "read-only":
+		readOnly = append(readOnly, protectHomePaths...)
+	case "tmpfs":
+		for _, path := range protectHomePaths {
+			if _, err := os.Stat(path); err != nil {
+				continue
+			}
+			if err := syscall.Mount("tmpfs", path, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_RDONLY, "mode=0755"); err != nil {
+				return fmt.Errorf("cannot mount tmpfs on %s: %s", path, err.Error())
+			}
+		}
+	}
+	for _, path := range sb.ReadOnlyPaths {
+		if ok, err := sandboxPathExists(path, path); !ok {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		readOnly = append(readOnly, strings.TrimPrefix(path, "-"))
+	}
+	for _, path := range sb.InaccessiblePaths {
+		if ok, err := sandboxPathExists(path, path); !ok {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		inaccessible = append(inaccessible, strings.TrimPrefix(path, "-"))
+	}
+
+	if err := makeReadOnly(readOnly, writable); err != nil {
+		return err
+	}
+
+	for _, path := range inaccessible {
+		if err := makeInaccessible(path); err != nil {
+			return fmt.Errorf("cannot make %s inaccessible: %s", path, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// loopbackUp sets the lo interface of the network namespace up, it is down in a new one
+func loopbackUp() error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	// struct ifreq, the name then the flags of the union
+	var ifr [40]byte
+	copy(ifr[:], "lo")
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCGIFFLAGS, uintptr(unsafe.Pointer(&ifr[0]))); errno != 0 {
+		return errno
+	}
+	*(*uint16)(unsafe.Pointer(&ifr[syscall.IFNAMSIZ])) |= syscall.IFF_UP
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCSIFFLAGS, uintptr(unsafe.Pointer(&ifr[0]))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// sandboxPathExists checks path, the setting has the "-" prefix when it is optional.
+// A missing path is only an error when mandatory.
+func sandboxPathExists(setting, path string) (bool, error) {
+	_, err := os.Stat(strings.TrimPrefix(path, "-"))
+	if err == nil {
+		return true, nil
+	}
+	if os.IsNotExist(err) && strings.HasPrefix(setting, "-") {
+		return false, nil
+	}
+	return false, fmt.Errorf("cannot use %s: %s", setting, err.Error())
+}
+
+// rootDir creates the directory path with mode, or checks that the existing one is a directory
+// of root and not a symlink
+func rootDir(path string, mode os.FileMode) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		if err := os.Mkdir(path, mode); err != nil {
+			return err
+		}
+		fi, err = os.Lstat(path)
+	}
+	if err != nil {
+		return err
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); !fi.IsDir() || !ok || st.Uid != 0 {
+		return fmt.Errorf("%s is not a directory owned by root", path)
+	}
+	return os.Chmod(path, mode)
+}
+
+// privateTmp binds the private directory of the service on base
+func privateTmp(base string, name ServiceName) error {
+	if err := os.MkdirAll(filepath.Dir(privateTmpRoot), 0755); err != nil {
+		return err
+	}
+	dir := privateTmpDir(base, name)
+	for _, path := range []string{privateTmpRoot, filepath.Dir(dir)} {
+		if err := rootDir(path, 0700); err != nil {
+			return err
+		}
+	}
+	if err := rootDir(dir, 0777|os.ModeSticky); err != nil {
+		return err
+	}
+	return BindMount(dir, base)
+}
+
+// ensureMountPoint binds path on itself if it is not already a mount point
+func ensureMountPoint(path string) error {
+	points, err := MountPoints()
+	if err != nil {
+		return err
+	}
+	for _, p := range points {
+		if p == path {
+			return nil
+		}
+	}
+	return BindMount(path, path)
+}
+
+// makeReadOnly remounts read-only the paths and all the mounts under them, except the writable
+// paths inside them
+func makeReadOnly(paths, writable []string) error {
+	for _, path := range paths {
+		// Only the ProtectSystem and ProtectHome ones may be missing, the others are checked
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		if err := ensureMountPoint(path); err != nil {
+			return fmt.Errorf("cannot make %s read-only: %s", path, err.Error())
+		}
+	}
+
+	points, err := MountPoints()
+	if err != nil {
+		return err
+	}
+	done := make(map[string]bool)
+	for _, path := range paths {
+		for _, point := range points {
+			if done[point] || !pathUnder(point, path) || keepWritable(point, path, writable) {
+				continue
+			}
+			if err := RemountReadOnly(point); err != nil {
+				return fmt.Errorf("cannot make %s read-only: %s", point, err.Error())
+			}
+			done[point] = true
+		}
+	}
+	return nil
+}
+
+// keepWritable if point, under the read-only path, is in one of the writable paths inside path,
+// or in an API filesystem with /
+func keepWritable(point, path string, writable []string) bool {
+	for _, w := range writable {
+		if pathUnder(point, w) && pathUnder(w, path) && w != path {
+			return true
+		}
+	}
+	if path == "/" {
+		for _, api := range apiPaths {
+			if pathUnder(point, api) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// makeInaccessible hides a directory under an empty tmpfs nobody may enter, and a file under
+// /dev/null which reads as empty
+func makeInaccessible(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil
+	}
+	if fi.IsDir() {
+		flags := uintptr(syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC | syscall.MS_RDONLY)
+		return syscall.Mount("tmpfs", path, "tmpfs", flags, "mode=000")
+	}
+	if err := syscall.Mount("/dev/null", path, "", syscall.MS_BIND, ""); err != nil {
+		return err
+	}
+	return RemountReadOnly(path)
+}
+
+// pathUnder tells if path is dir or inside it
+func pathUnder(path, dir string) bool {
+	return path == dir || dir == "/" || strings.HasPrefix(path, dir+"/")
+}
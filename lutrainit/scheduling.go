@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Scheduling of the processes of a service, unset fields are inherited from lutrainit
+type Scheduling struct {
+	Nice           *int
+	OOMScoreAdjust *int
+
+	IOSchedulingClass    string // realtime, best-effort or idle
+	IOSchedulingPriority int    // 0 (highest) to 7
+
+	CPUSchedulingPolicy   string // other, batch, idle, fifo or rr
+	CPUSchedulingPriority int    // 1 to 99, for fifo and rr
+
+	CPUAffinity []int
+}
+
+// IsSet if anything must be changed
+func (sc Scheduling) IsSet() bool {
+	return sc.Nice != nil || sc.OOMScoreAdjust != nil || sc.IOSchedulingClass != "" ||
+		sc.CPUSchedulingPolicy != "" || len(sc.CPUAffinity) > 0
+}
+
+var (
+	ioSchedulingClasses = map[string]int{
+		"realtime":    1,
+		"best-effort": 2,
+		"idle":        3,
+	}
+
+	cpuSchedulingPolicies = map[string]int{
+		"other": 0,
+		"fifo":  1,
+		"rr":    2,
+		"batch": 3,
+		"idle":  5,
+	}
+)
+
+// check the values and the ranges of the settings
+func (sc Scheduling) check() error {
+	if sc.Nice != nil && (*sc.Nice < -20 || *sc.Nice > 19) {
+		return fmt.Errorf("Nice must be between -20 and 19")
+	}
+	if sc.OOMScoreAdjust != nil && (*sc.OOMScoreAdjust < -1000 || *sc.OOMScoreAdjust > 1000) {
+		return fmt.Errorf("OOMScoreAdjust must be between -1000 and 1000")
+	}
+	if _, ok := ioSchedulingClasses[sc.IOSchedulingClass]; sc.IOSchedulingClass != "" && !ok {
+		return fmt.Errorf("unknown IOSchedulingClass %s, must be realtime, best-effort or idle", sc.IOSchedulingClass)
+	}
+	if sc.IOSchedulingPriority < 0 || sc.IOSchedulingPriority > 7 {
+		return fmt.Errorf("IOSchedulingPriority must be between 0 and 7")
+	}
+	if _, ok := cpuSchedulingPolicies[sc.CPUSchedulingPolicy]; sc.CPUSchedulingPolicy != "" && !ok {
+		return fmt.Errorf("unknown CPUSchedulingPolicy %s, must be other, batch, idle, fifo or rr", sc.CPUSchedulingPolicy)
+	}
+	realtime := sc.CPUSchedulingPolicy == "fifo" || sc.CPUSchedulingPolicy == "rr"
+	if realtime && (sc.CPUSchedulingPriority < 1 || sc.CPUSchedulingPriority > 99) {
+		return fmt.Errorf("CPUSchedulingPriority must be between 1 and 99 with %s", sc.CPUSchedulingPolicy)
+	}
+	if !realtime && sc.CPUSchedulingPriority != 0 {
+		return fmt.Errorf("CPUSchedulingPriority is only for the fifo and rr policies")
+	}
+	return nil
+}
+
+// parseCPUList parses "0 2-3" or "0,2-3"
+func parseCPUList(list string) ([]int, error) {
+	var cpus []int
+	for _, item := range strings.FieldsFunc(list, func(r rune) bool { return r == ',' || r == ' ' }) {
+		bounds := strings.SplitN(item, "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil || first < 0 {
+			return nil, fmt.Errorf("invalid CPU %s", item)
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, err = strconv.Atoi(bounds[1]); err != nil || last < first {
+				return nil, fmt.Errorf("invalid CPU range %s", item)
+			}
+		}
+		for cpu := first; cpu <= last; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpus, nil
+}
+
+// optionalInt returns nil for an empty value
+func optionalInt(val string) (*int, error) {
+	if val == "" {
+		return nil, nil
+	}
+	i, err := strconv.Atoi(val)
+	if err != nil {
+		return nil, err
+	}
+	return &i, nil
+}
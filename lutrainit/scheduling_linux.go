@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	ioprioWhoProcess = 1
+	ioprioClassShift = 13
+)
+
+// apply the scheduling to the calling thread, which must be locked as it is the one doing the exec.
+// Most of these settings are per thread.
+func (sc Scheduling) apply() error {
+	if sc.OOMScoreAdjust != nil {
+		if err := ioutil.WriteFile("/proc/self/oom_score_adj", []byte(strconv.Itoa(*sc.OOMScoreAdjust)), 0644); err != nil {
+			return fmt.Errorf("cannot set OOMScoreAdjust: %s", err.Error())
+		}
+	}
+
+	if sc.CPUSchedulingPolicy != "" {
+		param := int32(sc.CPUSchedulingPriority)
+		policy := cpuSchedulingPolicies[sc.CPUSchedulingPolicy]
+		if _, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_SETSCHEDULER, 0, uintptr(policy), uintptr(unsafe.Pointer(&param))); errno != 0 {
+			return fmt.Errorf("cannot set CPUSchedulingPolicy: %s", errno.Error())
+		}
+	}
+
+	// After the policy, the idle one resets the nice value
+	if sc.Nice != nil {
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, 0, *sc.Nice); err != nil {
+			return fmt.Errorf("cannot set Nice: %s", err.Error())
+		}
+	}
+
+	if sc.IOSchedulingClass != "" {
+		prio := ioSchedulingClasses[sc.IOSchedulingClass]<<ioprioClassShift | sc.IOSchedulingPriority
+		if _, _, errno := syscall.RawSyscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, 0, uintptr(prio)); errno != 0 {
+			return fmt.Errorf("cannot set IOSchedulingClass: %s", errno.Error())
+		}
+	}
+
+	if len(sc.CPUAffinity) > 0 {
+		max := 0
+		for _, cpu := range sc.CPUAffinity {
+			if cpu > max {
+				max = cpu
+			}
+		}
+		mask := make([]uint64, max/64+1)
+		for _, cpu := range sc.CPUAffinity {
+			mask[cpu/64] |= 1 << uint(cpu%64)
+		}
+		if _, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_SETAFFINITY, 0, uintptr(len(mask)*8), uintptr(unsafe.Pointer(&mask[0]))); errno != 0 {
+			return fmt.Errorf("cannot set CPUAffinity: %s", errno.Error())
+		}
+	}
+
+	return nil
+}
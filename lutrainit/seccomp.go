@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Seccomp filter of the system calls of the processes of a service
+type Seccomp struct {
+	SystemCalls           []string // names, with the groups expanded
+	DenySystemCalls       bool     // SystemCalls are denied, else only them are allowed
+	SystemCallErrorNumber int      // errno of the denied system calls, 0 kills the process
+}
+
+// IsSet if there is a filter
+func (sc Seccomp) IsSet() bool {
+	return len(sc.SystemCalls) > 0
+}
+
+// systemCallGroups are the @groups of SystemCallFilter, they may include other groups. Names which
+// don't exist on an architecture are skipped. @default is always allowed with an allow list.
+var systemCallGroups = map[string][]string{
+	"@default": {"arch_prctl", "brk", "cacheflush", "clock_getres", "clock_gettime", "clock_nanosleep", "execve",
+		"exit", "exit_group", "futex", "get_robust_list", "get_thread_area", "getegid", "geteuid", "getgid",
+		"getgroups", "getpgid", "getpgrp", "getpid", "getppid", "getrandom", "getresgid", "getresuid", "getrlimit",
+		"getsid", "gettid", "gettimeofday", "getuid", "membarrier", "mmap", "mprotect", "munmap", "nanosleep",
+		"pause", "prlimit64", "restart_syscall", "rseq", "rt_sigreturn", "sched_getaffinity", "sched_yield",
+		"set_robust_list", "set_thread_area", "set_tid_address", "time"},
+	"@basic-io": {"close", "close_range", "dup", "dup2", "dup3", "lseek", "pread64", "preadv", "preadv2", "pwrite64",
+		"pwritev", "pwritev2", "read", "readv", "write", "writev"},
+	"@clock": {"adjtimex", "clock_adjtime", "clock_settime", "settimeofday"},
+	"@debug": {"lookup_dcookie", "perf_event_open", "pidfd_getfd", "process_vm_readv", "process_vm_writev", "ptrace"},
+	"@file-system": {"access", "chdir", "chmod", "close", "creat", "faccessat", "faccessat2", "fallocate", "fchdir",
+		"fchmod", "fchmodat", "fchmodat2", "fcntl", "fgetxattr", "flistxattr", "fremovexattr", "fsetxattr", "fstat",
+		"fstatfs", "ftruncate", "futimesat", "getcwd", "getdents", "getdents64", "getxattr", "inotify_add_watch",
+		"inotify_init", "inotify_init1", "inotify_rm_watch", "lgetxattr", "link", "linkat", "listxattr",
+		"llistxattr", "lremovexattr", "lsetxattr", "lstat", "mkdir", "mkdirat", "mknod", "mknodat", "mmap",
+		"munmap", "newfstatat", "open", "openat", "openat2", "readlink", "readlinkat", "removexattr", "rename",
+		"renameat", "renameat2", "rmdir", "setxattr", "stat", "statfs", "statx", "symlink", "symlinkat", "truncate",
+		"unlink", "unlinkat", "utime", "utimensat", "utimes"},
+	"@io-event": {"epoll_create", "epoll_create1", "epoll_ctl", "epoll_pwait", "epoll_pwait2", "epoll_wait", "eventfd",
+		"eventfd2", "poll", "ppoll", "pselect6", "select"},
+	"@ipc": {"memfd_create", "mq_getsetattr", "mq_notify", "mq_open", "mq_timedreceive", "mq_timedsend", "mq_unlink",
+		"msgctl", "msgget", "msgrcv", "msgsnd", "pipe", "pipe2", "semctl", "semget", "semop", "semtimedop", "shmat",
+		"shmctl", "shmdt", "shmget"},
+	"@module": {"delete_module", "finit_module", "init_module"},
+	"@mount": {"chroot", "fsconfig", "fsmount", "fsopen", "fspick", "mount", "mount_setattr", "move_mount",
+		"open_tree", "pivot_root", "umount", "umount2"},
+	"@network-io": {"accept", "accept4", "bind", "connect", "getpeername", "getsockname", "getsockopt", "listen",
+		"recv", "recvfrom", "recvmmsg", "recvmsg", "send", "sendmmsg", "sendmsg", "sendto", "setsockopt",
+		"shutdown", "socket", "socketpair"},
+	"@process": {"capget", "clone", "clone3", "execveat", "fork", "getrusage", "kill", "pidfd_open",
+		"pidfd_send_signal", "prctl", "rt_sigqueueinfo", "rt_tgsigqueueinfo", "setns", "tgkill", "times", "tkill",
+		"unshare", "vfork", "wait4", "waitid"},
+	"@raw-io": {"ioperm", "iopl", "pciconfig_iobase", "pciconfig_read", "pciconfig_write"},
+	"@reboot": {"kexec_file_load", "kexec_load", "reboot"},
+	"@setuid": {"setfsgid", "setfsuid", "setgid", "setgroups", "setregid", "setresgid", "setresuid", "setreuid",
+		"setuid"},
+	"@signal": {"rt_sigaction", "rt_sigpending", "rt_sigprocmask", "rt_sigsuspend", "rt_sigtimedwait", "sigaltstack",
+		"signalfd", "signalfd4"},
+	"@swap": {"swapoff", "swapon"},
+	// What most daemons need, to start an allow list with
+	"@system-service": {"@basic-io", "@file-system", "@io-event", "@ipc", "@network-io", "@process", "@setuid",
+		"@signal", "alarm", "capset", "chown", "copy_file_range", "fadvise64", "fchown", "fchownat", "fdatasync",
+		"flock", "fsync", "getcpu", "getitimer", "getpriority", "ioctl", "ioprio_get", "lchown", "madvise", "mlock",
+		"mremap", "msync", "munlock", "sched_getparam", "sched_getscheduler", "sendfile", "setitimer", "setpgid",
+		"setrlimit", "setsid", "splice", "sync", "sync_file_range", "syncfs", "sysinfo", "tee", "timerfd_create",
+		"timerfd_gettime", "timerfd_settime", "umask", "uname"},
+}
+
+// errnoNames are the names accepted by SystemCallErrorNumber, besides numbers
+var errnoNames = map[string]syscall.Errno{
+	"EPERM":           syscall.EPERM,
+	"ENOENT":          syscall.ENOENT,
+	"EIO":             syscall.EIO,
+	"EAGAIN":          syscall.EAGAIN,
+	"ENOMEM":          syscall.ENOMEM,
+	"EACCES":          syscall.EACCES,
+	"EBUSY":           syscall.EBUSY,
+	"EEXIST":          syscall.EEXIST,
+	"EINVAL":          syscall.EINVAL,
+	"ENOTTY":          syscall.ENOTTY,
+	"EROFS":           syscall.EROFS,
+	"ENOSYS":          syscall.ENOSYS,
+	"ENOTSUP":         syscall.ENOTSUP,
+	"EPROTONOSUPPORT": syscall.EPROTONOSUPPORT,
+	"EAFNOSUPPORT":    syscall.EAFNOSUPPORT,
+	"ENETUNREACH":     syscall.ENETUNREACH,
+	"ECONNREFUSED":    syscall.ECONNREFUSED,
+}
+
+// parseSeccomp parses the SystemCallFilter lines, each one a space separated list of system calls
+// and @groups, denied with a "~" prefix, and the SystemCallErrorNumber
+func parseSeccomp(filters []string, errno string) (sc Seccomp, err error) {
+	names := make(map[string]bool)
+	mode := ""
+	for _, filter := range filters {
+		filter = strings.TrimSpace(filter)
+		if filter == "" {
+			continue
+		}
+		if len(systemCallNumbers) == 0 {
+			return sc, fmt.Errorf("SystemCallFilter is not supported here")
+		}
+		lineMode := "allow"
+		if strings.HasPrefix(filter, "~") {
+			lineMode = "deny"
+			filter = filter[1:]
+		}
+		if mode != "" && mode != lineMode {
+			return sc, fmt.Errorf("SystemCallFilter cannot both allow and deny")
+		}
+		mode = lineMode
+
+		for _, name := range strings.Fields(filter) {
+			if err := addSystemCalls(names, name); err != nil {
+				return sc, err
+			}
+		}
+	}
+	if mode == "" {
+		return sc, nil
+	}
+
+	sc.DenySystemCalls = mode == "deny"
+	// What the exec of the command needs
+	if !sc.DenySystemCalls {
+		addSystemCalls(names, "@default")
+	}
+	for name := range names {
+		sc.SystemCalls = append(sc.SystemCalls, name)
+	}
+	sort.Strings(sc.SystemCalls)
+
+	if sc.SystemCallErrorNumber, err = parseErrno(errno); err != nil {
+		return sc, fmt.Errorf("SystemCallErrorNumber: %s", err.Error())
+	}
+	return sc, nil
+}
+
+// addSystemCalls adds name, or the system calls of the @group name, to names
+func addSystemCalls(names map[string]bool, name string) error {
+	if strings.HasPrefix(name, "@") {
+		group, ok := systemCallGroups[name]
+		if !ok {
+			return fmt.Errorf("unknown system call group %s", name)
+		}
+		for _, call := range group {
+			if strings.HasPrefix(call, "@") {
+				addSystemCalls(names, call)
+			} else if _, ok := systemCallNumbers[call]; ok {
+				names[call] = true
+			}
+		}
+		return nil
+	}
+
+	if _, ok := systemCallNumbers[name]; !ok {
+		return fmt.Errorf("unknown system call %s", name)
+	}
+	names[name] = true
+	return nil
+}
+
+// parseErrno parses an errno name like EPERM or a number, "" or kill are 0
+func parseErrno(errno string) (int, error) {
+	if errno == "" || errno == "kill" {
+		return 0, nil
+	}
+	if e, ok := errnoNames[strings.ToUpper(errno)]; ok {
+		return int(e), nil
+	}
+	n, err := strconv.Atoi(errno)
+	if err != nil || n < 1 || n > 4095 {
+		return 0, fmt.Errorf("unknown errno %s", errno)
+	}
+	return n, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	seccompModeFilter = 2
+
+	seccompRetKillProcess = 0x80000000
+	seccompRetErrno       = 0x00050000
+	seccompRetAllow       = 0x7fff0000
+
+	// Offsets in struct seccomp_data
+	seccompDataNr   = 0
+	seccompDataArch = 4
+)
+
+// program compiles the filter to a classic BPF program: one test per system call, in sequence
+func (sc Seccomp) program() []syscall.SockFilter {
+	deny := uint32(seccompRetKillProcess)
+	if sc.SystemCallErrorNumber != 0 {
+		deny = seccompRetErrno | uint32(sc.SystemCallErrorNumber)
+	}
+	match, others := uint32(seccompRetAllow), deny
+	if sc.DenySystemCalls {
+		match, others = deny, seccompRetAllow
+	}
+
+	stmt := func(code uint16, k uint32) syscall.SockFilter {
+		return syscall.SockFilter{Code: code, K: k}
+	}
+	jump := func(code uint16, k uint32, jt, jf uint8) syscall.SockFilter {
+		return syscall.SockFilter{Code: code, Jt: jt, Jf: jf, K: k}
+	}
+
+	prog := []syscall.SockFilter{
+		// The numbers are only the ones of our architecture
+		stmt(syscall.BPF_LD|syscall.BPF_W|syscall.BPF_ABS, seccompDataArch),
+		jump(syscall.BPF_JMP|syscall.BPF_JEQ|syscall.BPF_K, auditArch, 1, 0),
+		stmt(syscall.BPF_RET|syscall.BPF_K, seccompRetKillProcess),
+		stmt(syscall.BPF_LD|syscall.BPF_W|syscall.BPF_ABS, seccompDataNr),
+	}
+	if x32SyscallBit != 0 {
+		prog = append(prog,
+			jump(syscall.BPF_JMP|syscall.BPF_JGE|syscall.BPF_K, x32SyscallBit, 0, 1),
+			stmt(syscall.BPF_RET|syscall.BPF_K, deny))
+	}
+	for _, name := range sc.SystemCalls {
+		prog = append(prog,
+			jump(syscall.BPF_JMP|syscall.BPF_JEQ|syscall.BPF_K, systemCallNumbers[name], 0, 1),
+			stmt(syscall.BPF_RET|syscall.BPF_K, match))
+	}
+	return append(prog, stmt(syscall.BPF_RET|syscall.BPF_K, others))
+}
+
+// install the filter on the calling thread, it must be the last thing before the exec of the command.
+// Without CAP_SYS_ADMIN, the kernel wants no_new_privs first.
+func (sc Seccomp) install() error {
+	if !sc.IsSet() {
+		return nil
+	}
+	if len(systemCallNumbers) == 0 {
+		return fmt.Errorf("SystemCallFilter is not supported on this architecture")
+	}
+
+	filter := sc.program()
+	prog := syscall.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	set := func() syscall.Errno {
+		_, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, syscall.PR_SET_SECCOMP, seccompModeFilter, uintptr(unsafe.Pointer(&prog)), 0, 0, 0)
+		return errno
+	}
+
+	errno := set()
+	if errno == syscall.EACCES {
+		if err := prctl(prSetNoNewPrivs, 1); err != nil {
+			return fmt.Errorf("cannot set no_new_privs for SystemCallFilter: %s", err.Error())
+		}
+		errno = set()
+	}
+	if errno != 0 {
+		return fmt.Errorf("cannot install SystemCallFilter: %s", errno.Error())
+	}
+	return nil
+}
@@ -0,0 +1,12 @@
+//go:build !amd64 && !arm64
+// +build !amd64,!arm64
+
+package main
+
+const (
+	auditArch     = 0
+	x32SyscallBit = 0
+)
+
+// systemCallNumbers is empty, SystemCallFilter only knows amd64 and arm64
+var systemCallNumbers = map[string]uint32{}
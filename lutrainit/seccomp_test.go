@@ -0,0 +1,98 @@
+package main
+
+import (
+	"syscall"
+	"testing"
+)
+
+func TestSystemCallGroups(t *testing.T) {
+	if len(systemCallNumbers) == 0 {
+		t.Skip("SystemCallFilter is not supported here")
+	}
+
+	for group, calls := range systemCallGroups {
+		for _, call := range calls {
+			if _, ok := systemCallGroups[call]; call[0] == '@' && !ok {
+				t.Errorf("%s includes the unknown group %s", group, call)
+			}
+		}
+
+		names := make(map[string]bool)
+		if err := addSystemCalls(names, group); err != nil {
+			t.Errorf("%s: %s", group, err.Error())
+		}
+		if len(names) == 0 {
+			t.Errorf("%s has no system call on this architecture", group)
+		}
+	}
+}
+
+func TestParseSeccomp(t *testing.T) {
+	if len(systemCallNumbers) == 0 {
+		t.Skip("SystemCallFilter is not supported here")
+	}
+
+	tests := []struct {
+		filters []string
+		name    string
+		deny    bool
+		has     []string
+		hasNot  []string
+		errno   int
+	}{
+		{filters: nil},
+		{filters: []string{"", " "}},
+		{filters: []string{"@system-service"}, has: []string{"read", "socket", "execve", "setuid"}, hasNot: []string{"reboot", "mount"}},
+		{filters: []string{"read write", "getpid"}, name: "EPERM", has: []string{"read", "write", "getpid", "exit_group"}, hasNot: []string{"socket"}, errno: int(syscall.EPERM)},
+		{filters: []string{"~@reboot @swap", "~ptrace"}, name: "1", deny: true, has: []string{"reboot", "swapon", "ptrace"}, hasNot: []string{"execve"}, errno: 1},
+		{filters: []string{"~@mount"}, name: "kill", deny: true, has: []string{"mount", "umount2"}},
+	}
+	for _, test := range tests {
+		sc, err := parseSeccomp(test.filters, test.name)
+		if err != nil {
+			t.Errorf("%q: %s", test.filters, err.Error())
+			continue
+		}
+		if sc.DenySystemCalls != test.deny || sc.SystemCallErrorNumber != test.errno {
+			t.Errorf("%q: got deny %v errno %d", test.filters, sc.DenySystemCalls, sc.SystemCallErrorNumber)
+		}
+		calls := make(map[string]bool)
+		for _, call := range sc.SystemCalls {
+			calls[call] = true
+		}
+		for _, call := range test.has {
+			if !calls[call] {
+				t.Errorf("%q: %s is missing", test.filters, call)
+			}
+		}
+		for _, call := range test.hasNot {
+			if calls[call] {
+				t.Errorf("%q: %s should not be there", test.filters, call)
+			}
+		}
+	}
+}
+
+func TestParseSeccompErrors(t *testing.T) {
+	if len(systemCallNumbers) == 0 {
+		t.Skip("SystemCallFilter is not supported here")
+	}
+
+	tests := []struct {
+		filters []string
+		errno   string
+	}{
+		{filters: []string{"@nope"}},
+		{filters: []string{"read nosuchcall"}},
+		{filters: []string{"~@default @reboot2"}},
+		{filters: []string{"read", "~write"}},
+		{filters: []string{"read"}, errno: "ENOTANERRNO"},
+		{filters: []string{"read"}, errno: "0"},
+		{filters: []string{"read"}, errno: "4096"},
+	}
+	for _, test := range tests {
+		if _, err := parseSeccomp(test.filters, test.errno); err == nil {
+			t.Errorf("%q %q: no error", test.filters, test.errno)
+		}
+	}
+}
@@ -7,20 +7,15 @@ import (
 	"github.com/gyuho/goraph"
 	"github.com/mitchellh/go-ps"
 	"io/ioutil"
+	"net"
 	"os"
 	"os/exec"
 	"strconv"
 	"strings"
-	"sync"
 	"syscall"
 	"time"
 )
 
-const (
-	errWaitNoChild   = "wait: no child processes"
-	errWaitIDNoChild = "waitid: no child processes"
-)
-
 // ServiceName defines the service name
 type ServiceName string
 
@@ -71,6 +66,15 @@ const (
 	Reload
 	Restart
 	Forcekill
+	WaitReady
+)
+
+// Restart policies of simple and notify services
+const (
+	RestartNo         = "no"
+	RestartOnFailure  = "on-failure"
+	RestartOnAbnormal = "on-abnormal"
+	RestartAlways     = "always"
 )
 
 func (la LastAction) String() string {
@@ -95,6 +99,8 @@ func (la LastAction) String() string {
 		return "restart"
 	case Forcekill:
 		return "force kill"
+	case WaitReady:
+		return "waiting for ready notification"
 	default:
 		return "really unknown"
 	}
@@ -126,9 +132,11 @@ type Service struct {
 	LastMessage  string
 	LastKnownPID int
 
-	Type    string // forking or simple
+	Type    string // forking, simple, notify, oneshot or virtual
 	PIDFile string
 
+	TimeoutStart time.Duration // Time given to a notify service to send READY=1
+
 	Startup  Command
 	Shutdown Command
 
@@ -139,106 +147,145 @@ type Service struct {
 	ExecStop      Command
 	ExecPostStop  Command
 
+	// Restart policy, only used by simple and notify services
+	Restart            string
+	RestartSec         time.Duration
+	StartLimitBurst    int
+	StartLimitInterval time.Duration
+	RestartCount       int         // Number of automatic restarts done
+	RestartTimes       []time.Time // Automatic restarts in the current StartLimitInterval
+
+	// How to stop the service when ExecStop isn't enough
+	TimeoutStop time.Duration
+	KillSignal  syscall.Signal
+	KillMode    string
+	KilledBy    string // Signal which ended the process on the last stop
+
+	// Who and where its processes run
+	User                string
+	Group               string
+	SupplementaryGroups []string
+	WorkingDirectory    string
+	UMask               string
+
+	// Environment of its processes, Environment are KEY=VAL
+	Environment      []string
+	EnvironmentFiles []string
+
+	// setrlimit limits, over the defaults of lutra.conf
+	Rlimits []Rlimit
+	Scheduling
+	Sandbox
+	Capabilities
+	Seccomp
+
+	// Socket units: what they listen on, and the service started on the first activity
+	Listen             []Listen
+	SocketService      ServiceName
+	SocketMode         os.FileMode // of the unix sockets and FIFOs
+	FileDescriptorName string
+	ListenFDs          []int       // Opened fds, kept through a reexec
+	TriggerTimes       []time.Time // Activations in the last triggerInterval, of a socket or path unit
+
+	// Socket units accepting the connections for instances of their template service
+	Accept                  bool
+	MaxConnections          int
+	MaxConnectionsPerSource int         // 0 for no limit
+	Instance                ServiceName // of the copy of a template serving one connection, the name of its cgroup
+
+	// Timer units: when they start their service
+	OnCalendar         []string
+	OnBootSec          time.Duration
+	OnUnitActiveSec    time.Duration // after the last trigger
+	RandomizedDelaySec time.Duration
+	Persistent         bool
+	TimerService       ServiceName
+	LastTrigger        time.Time // kept in timerStampDir when Persistent
+	NextElapse         time.Time
+
+	// Path units: what they watch, and the service started when it fires
+	PathWatches   []PathWatch
+	PathService   ServiceName
+	MakeDirectory bool        // of the watched directories
+	DirectoryMode os.FileMode // of the directories made
+	// Limits of its cgroup, empty or 0 when unset
+	MemoryMax string // bytes or max
+	CPUWeight int
+	CPUQuota  int // percentage of one CPU
+	TasksMax  string
+	IOWeight  int
+
+	// Where the output of its processes goes: log, file:PATH, null or console
+	StandardOutput string
+	StandardError  string
+
 	Deleted  bool
 	Filename string
 
 	// Topo dependencies
-	Requires []string
-	Before   []string
-	After    []string
-	WantedBy string
+	Requires  []string
+	Wants     []string // like Requires, without failing when they do
+	BindsTo   []string // like Requires, and stopped when they stop
+	PartOf    []string // stopped and restarted with them
+	Conflicts []string // stopped when they start, and the other way around
+	Before    []string
+	After     []string
+	WantedBy  []string
+
+	// Devices: started when they appear, stopped when they go away
+	BindsToDevice  string        // /dev or /sys path, it cannot start without it
+	WantedByDevice []DeviceMatch // any of them
 
 	Node goraph.ID
 }
 
-// StartServices starts all declared services at start
-// There were a mutex for Read and Write of the old StartedServices, we don't use that anymore
-// The LoadedServices does have his own mutex, used by the services's .Start/Stop etc. functions.
-func StartServices() {
-	// Work target by target, one mutex waitgroup per target, one after another
-	for _, target := range OrderedTargets {
-		wg := sync.WaitGroup{}
-
-		wg.Add(len(OrderedServices[target])) // Add the number of services in this target to the waitgroup
-
-		// For each service, start them
-		for _, serviceName := range OrderedServices[target] {
-			service := LoadedServices[serviceName] // this is the service to start
-
-			go func(s *Service) {
-				// TODO: This should ensure that Requires are satisfiable instead of getting into an
-				// infiniteloop when they're not.
-				// (TODO(2): Prove N=NP (P=NP no ?) in order to do the above efficiently.)
-				for satisfied, tries := false, 0; satisfied == false && tries < 60; tries++ {
-					satisfied = s.RequiredSatisfied()
-					time.Sleep(2 * time.Second)
-				}
-
-				if s.State == NotStarted && s.AutoStart {
-					// Start the service
-					if s.Type == "oneshot" || s.Type == "forking" {
-						if err := s.Start(); err != nil {
-							clog.Error(2, err.Error())
-						}
-					} else if s.Type == "simple" {
-						go s.StartSimple()
-					} else {
-						// What are you doing here ?
-						clog.Warn("I don't know why but I'm asked to start %s with type %s", s.Name, s.Type)
-					}
-				}
-				wg.Done()
-			}(service)
-		}
-		wg.Wait() // Wait until all services are started in this target
-	}
-}
-
 // Start the Service s. if type is oneshot or forking
+// The lock is only held while updating the service, not while the commands run,
+// so that services can be started in parallel.
 func (s Service) Start() error {
 	LoadedServicesMu.Lock()
-	defer LoadedServicesMu.Unlock()
-
-	if s.State != NotStarted {
-		return fmt.Errorf("Service %v is %v", s.Name, s.State.String())
+	if state := LoadedServices[s.Name].State; state == Starting || state == Started {
+		LoadedServicesMu.Unlock()
+		return fmt.Errorf("Service %v is %v", s.Name, state.String())
 	}
 	s.State = Starting
-	LoadedServices[s.Name].State = Starting
+	setState(s.Name, Starting)
 	LoadedServices[s.Name].LastActionAt = time.Now().UTC().Unix()
 	LoadedServices[s.Name].LastAction = Start
+	LoadedServices[s.Name].KilledBy = ""
+	LoadedServicesMu.Unlock()
 
 	if s.ExecPreStart != "" {
+		LoadedServicesMu.Lock()
 		LoadedServices[s.Name].LastActionAt = time.Now().UTC().Unix()
 		LoadedServices[s.Name].LastAction = PreStart
+		LoadedServicesMu.Unlock()
 
-		err := justExecACommand(s.ExecPreStart.String())
+		err := s.runCommand(s.ExecPreStart)
 		if err != nil {
 			clog.Error(2, "error in %s ExecPreStart: %s", s.Name, err.Error())
+			LoadedServicesMu.Lock()
+			s.State = Errored
+			setState(s.Name, Errored)
+			LoadedServices[s.Name].LastMessage = fmt.Sprintf("ExecPreStart failed: %s", err.Error())
+			LoadedServicesMu.Unlock()
 			return err
 		}
 	}
 
-	cmd := exec.Command("sh", "-c", s.Startup.String())
-	cmd.Stderr = os.Stderr
-	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
-
-	if err := cmd.Run(); err != nil {
-		if err.Error() == errWaitNoChild || err.Error() == errWaitIDNoChild {
-			// Process exited cleanly
-			s.State = Started
-			LoadedServices[s.Name].State = Started
-			LoadedServices[s.Name].LastActionAt = time.Now().UTC().Unix()
-			LoadedServices[s.Name].LastAction = Start
-
-			clog.Info("[lutra] Started service %s", s.Name)
-
-			return nil
-		}
+	cmd, err := s.command(s.ExecStart)
+	if err == nil {
+		err = runChild(cmd)
+	}
+	if err != nil {
+		LoadedServicesMu.Lock()
+		defer LoadedServicesMu.Unlock()
 
 		s.State = Errored
-		LoadedServices[s.Name].State = Errored
+		setState(s.Name, Errored)
 		LoadedServices[s.Name].LastActionAt = time.Now().UTC().Unix()
 		LoadedServices[s.Name].LastAction = Start
+		LoadedServices[s.Name].LastMessage = err.Error()
 
 		clog.Error(2, "[lutra] Error starting service %s: %s", s.Name, err.Error())
 
@@ -246,20 +293,29 @@ func (s Service) Start() error {
 	}
 
 	if s.ExecPostStart != "" {
+		LoadedServicesMu.Lock()
 		LoadedServices[s.Name].LastActionAt = time.Now().UTC().Unix()
 		LoadedServices[s.Name].LastAction = PostStart
+		LoadedServicesMu.Unlock()
 
-		err := justExecACommand(s.ExecPostStart.String())
+		err := s.runCommand(s.ExecPostStart)
 		if err != nil {
 			clog.Error(2, "error in %s ExecPostStart: %s", s.Name, err.Error())
+			LoadedServicesMu.Lock()
+			s.State = Errored
+			setState(s.Name, Errored)
+			LoadedServices[s.Name].LastMessage = fmt.Sprintf("ExecPostStart failed: %s", err.Error())
+			LoadedServicesMu.Unlock()
 			return err
 		}
 	}
 
+	LoadedServicesMu.Lock()
 	s.State = Started
-	LoadedServices[s.Name].State = Started
+	setState(s.Name, Started)
 	LoadedServices[s.Name].LastActionAt = time.Now().UTC().Unix()
 	LoadedServices[s.Name].LastAction = Start
+	LoadedServicesMu.Unlock()
 
 	clog.Info("[lutra] Started service %s", s.Name)
 
@@ -267,14 +323,15 @@ func (s Service) Start() error {
 }
 
 // StartSimple and track the PID and process state (for simple service without auto-fork function)
-// Please remember that this function locks in the middle (cmd.Wait()) for any mutex operation
+// Please remember that this function locks in the middle (child.Wait()) for any mutex operation
 func (s Service) StartSimple() {
 	LoadedServicesMu.Lock()
 	s.State = Starting
-	LoadedServices[s.Name].State = Starting
+	setState(s.Name, Starting)
 	LoadedServices[s.Name].LastActionAt = time.Now().UTC().Unix()
 	LoadedServices[s.Name].LastAction = Start
 	LoadedServices[s.Name].LastKnownPID = 0
+	LoadedServices[s.Name].KilledBy = ""
 	LoadedServicesMu.Unlock()
 
 	if s.ExecPreStart != "" {
@@ -283,20 +340,55 @@ func (s Service) StartSimple() {
 		LoadedServices[s.Name].LastAction = PreStart
 		LoadedServicesMu.Unlock()
 
-		err := justExecACommand(s.ExecPreStart.String())
+		err := s.runCommand(s.ExecPreStart)
 		if err != nil {
 			clog.Error(2, "error in %s ExecPreStart: %s", s.Name, err.Error())
+			LoadedServicesMu.Lock()
+			s.State = Errored
+			setState(s.Name, Errored)
+			LoadedServices[s.Name].LastMessage = fmt.Sprintf("ExecPreStart failed: %s", err.Error())
+			LoadedServicesMu.Unlock()
+			return
+		}
+	}
+
+	cmd, err := s.command(s.ExecStart)
+	if err != nil {
+		clog.Error(2, "[lutra] Cannot start service %s: %s", s.Name, err.Error())
+		LoadedServicesMu.Lock()
+		s.State = Errored
+		setState(s.Name, Errored)
+		LoadedServices[s.Name].LastMessage = err.Error()
+		LoadedServicesMu.Unlock()
+		return
+	}
+
+	// A notify service tells us itself when it is ready
+	var notifySock *net.UnixConn
+	if s.Type == "notify" {
+		var err error
+		notifySock, err = listenNotify(s)
+		if err != nil {
+			clog.Error(2, "[lutra] Cannot create notify socket for %s: %s", s.Name, err.Error())
+			LoadedServicesMu.Lock()
+			s.State = Errored
+			setState(s.Name, Errored)
+			LoadedServices[s.Name].LastMessage = err.Error()
+			LoadedServicesMu.Unlock()
 			return
 		}
+		cmd.Env = append(cmd.Env, fmt.Sprintf("NOTIFY_SOCKET=%s", notifySock.LocalAddr().String()))
 	}
 
-	cmd := exec.Command("sh", "-c", s.Startup.String())
-	cmd.Stderr = os.Stderr
-	if err := cmd.Start(); err != nil {
+	child, err := startChild(cmd)
+	if err != nil {
 		clog.Error(2, "[lutra] Service %s exited with error: %s", s.Name, err.Error())
+		if notifySock != nil {
+			notifySock.Close()
+		}
 		LoadedServicesMu.Lock()
 		s.State = Errored
-		LoadedServices[s.Name].State = Errored
+		setState(s.Name, Errored)
 		LoadedServices[s.Name].LastMessage = err.Error()
 		LoadedServices[s.Name].LastKnownPID = 0
 		LoadedServicesMu.Unlock()
@@ -304,26 +396,48 @@ func (s Service) StartSimple() {
 	}
 	// Waiting for the command to finish
 	LoadedServicesMu.Lock()
-	s.State = Started
-	LoadedServices[s.Name].State = Started
 	LoadedServices[s.Name].LastKnownPID = cmd.Process.Pid
-	LoadedServicesMu.Unlock()
-	clog.Info("[lutra] Started service %s", s.Name)
+	if notifySock != nil {
+		LoadedServices[s.Name].LastActionAt = time.Now().UTC().Unix()
+		LoadedServices[s.Name].LastAction = WaitReady
+		LoadedServicesMu.Unlock()
+
+		clog.Info("[lutra] Waiting for service %s to be ready", s.Name)
+		go s.readNotify(notifySock, cmd.Process.Pid)
+	} else {
+		s.State = Started
+		setState(s.Name, Started)
+		LoadedServicesMu.Unlock()
+
+		clog.Info("[lutra] Started service %s", s.Name)
+	}
+
+	err = child.Wait()
+	if notifySock != nil {
+		notifySock.Close()
+	}
+
+	// A stop asked by CheckAndStopService must not trigger the Restart policy
+	LoadedServicesMu.RLock()
+	stopAsked := isStopAction(LoadedServices[s.Name].LastAction)
+	LoadedServicesMu.RUnlock()
 
-	err := cmd.Wait()
 	if err != nil {
 		clog.Error(2, "[lutra] Service %s finished with error: %s", s.Name, err.Error())
 		LoadedServicesMu.Lock()
 		s.State = Stopped
-		LoadedServices[s.Name].State = Stopped
-		LoadedServices[s.Name].LastMessage = err.Error()
+		setState(s.Name, Stopped)
+		// Keep the reason why we killed it
+		if LoadedServices[s.Name].LastAction != Forcekill {
+			LoadedServices[s.Name].LastMessage = err.Error()
+		}
 		LoadedServices[s.Name].LastKnownPID = 0
 		LoadedServicesMu.Unlock()
 	} else {
 		LoadedServicesMu.Lock()
 		s.State = Stopped
 		clog.Info("[lutra] Service stopped:	 %s", s.Name)
-		LoadedServices[s.Name].State = Stopped
+		setState(s.Name, Stopped)
 		LoadedServices[s.Name].LastKnownPID = 0
 		LoadedServices[s.Name].LastActionAt = time.Now().UTC().Unix()
 		LoadedServices[s.Name].LastAction = Stop
@@ -336,13 +450,162 @@ func (s Service) StartSimple() {
 		LoadedServices[s.Name].LastAction = PostStart
 		LoadedServicesMu.Unlock()
 
-		err := justExecACommand(s.ExecPostStart.String())
+		err := s.runCommand(s.ExecPostStart)
 		if err != nil {
 			clog.Error(2, "error in %s ExecPostStart: %s", s.Name, err.Error())
+			if !stopAsked {
+				s.removePrivateTmp()
+			}
 			return
 		}
 	}
 
+	// A stop asked removes it once its commands are done
+	if !stopAsked {
+		s.removePrivateTmp()
+	}
+
+	if !stopAsked && !ShuttingDown && s.shouldRestart(err) {
+		s.autoRestart()
+	}
+}
+
+// shouldRestart tells if the Restart policy wants the service back after its process exited with err
+func (s Service) shouldRestart(err error) bool {
+	switch s.Restart {
+	case RestartAlways:
+		return true
+	case RestartOnFailure:
+		return err != nil
+	case RestartOnAbnormal:
+		return exitedBySignal(err)
+	default:
+		return false
+	}
+}
+
+// autoRestart starts again the service after RestartSec, or mark it as errored if it
+// has been restarted more than StartLimitBurst times in StartLimitInterval
+func (s Service) autoRestart() {
+	LoadedServicesMu.Lock()
+	ls := LoadedServices[s.Name]
+
+	// Only keep the restarts which are still in the rate limit interval
+	now := time.Now()
+	recent := make([]time.Time, 0, len(ls.RestartTimes)+1)
+	for _, t := range ls.RestartTimes {
+		if now.Sub(t) < ls.StartLimitInterval {
+			recent = append(recent, t)
+		}
+	}
+
+	if ls.StartLimitBurst > 0 && len(recent) >= ls.StartLimitBurst {
+		ls.RestartTimes = recent
+		setState(ls.Name, Errored)
+		ls.LastMessage = fmt.Sprintf("restarted %d times in %s, giving up", len(recent), ls.StartLimitInterval)
+		ls.LastActionAt = now.UTC().Unix()
+		LoadedServicesMu.Unlock()
+
+		clog.Error(2, "[lutra] Service %s hit its start limit, not restarting it anymore", s.Name)
+		return
+	}
+
+	ls.RestartTimes = append(recent, now)
+	ls.RestartCount++
+	ls.LastAction = Restart
+	ls.LastActionAt = now.UTC().Unix()
+	delay := ls.RestartSec
+	LoadedServicesMu.Unlock()
+
+	clog.Info("[lutra] Restarting service %s in %s", s.Name, delay)
+	time.Sleep(delay)
+
+	// Someone may have stopped or started the service in the meantime
+	LoadedServicesMu.RLock()
+	state, action := ls.State, ls.LastAction
+	LoadedServicesMu.RUnlock()
+	if ShuttingDown || action != Restart || state == Starting || state == Started {
+		return
+	}
+
+	go ls.StartSimple()
+}
+
+// isStopAction tells if la is one of the actions done while stopping a service
+func isStopAction(la LastAction) bool {
+	return la == PreStop || la == Stop || la == PostStop
+}
+
+// exitedBySignal tells if a Child.Wait() error comes from a process killed by a signal
+func exitedBySignal(err error) bool {
+	exitErr, ok := err.(*ExitError)
+	return ok && exitErr.Status.Signaled()
+}
+
+// setState changes the state of a loaded service and wakes up everyone waiting on
+// serviceStateChanged. LoadedServicesMu must be held.
+func setState(name ServiceName, state RunState) {
+	s := LoadedServices[name]
+	wasRunning := s.State == Starting || s.State == Started
+	s.State = state
+	serviceStateChanged.Broadcast()
+
+	// However it stopped, the services bound to it follow
+	if wasRunning && (state == Stopped || state == Errored) && !ShuttingDown {
+		go stopBoundTo(name)
+	}
+}
+
+// waitState waits on serviceStateChanged until done or timeout, and returns done.
+// LoadedServicesMu must be held.
+func waitState(done func() bool, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	// Wakes us up at the deadline if nothing changes
+	timer := time.AfterFunc(timeout, func() {
+		LoadedServicesMu.Lock()
+		serviceStateChanged.Broadcast()
+		LoadedServicesMu.Unlock()
+	})
+	defer timer.Stop()
+
+	for !done() {
+		if !time.Now().Before(deadline) {
+			return false
+		}
+		serviceStateChanged.Wait()
+	}
+	return true
+}
+
+// running if it is starting, or started and not done: a oneshot stays started once finished.
+// LoadedServicesMu must be held.
+func (s Service) running() bool {
+	return s.State == Starting || (s.State == Started && s.Type != "oneshot")
+}
+
+// launch starts s the way its type is, a oneshot done is started again. LoadedServicesMu must be
+// held, it is released while a oneshot or forking service runs its commands.
+func launch(s *Service) {
+	if s.IsSupervised() {
+		// Starting right away, else the units triggering it could see it stopped
+		setState(s.Name, Starting)
+		go s.StartSimple()
+		return
+	}
+	if s.Type != "oneshot" && s.Type != "forking" {
+		// What are you doing here ?
+		clog.Warn("I don't know why but I'm asked to start %s with type %s", s.Name, s.Type)
+		return
+	}
+
+	if s.Type == "oneshot" && s.State == Started {
+		setState(s.Name, Stopped)
+	}
+	LoadedServicesMu.Unlock()
+	if err := s.Start(); err != nil {
+		clog.Error(2, "[lutra] Cannot start %s: %s", s.Name, err.Error())
+	}
+	LoadedServicesMu.Lock()
 }
 
 // RequiredSatisfied if all of service required are satified
@@ -355,6 +618,11 @@ func (s Service) RequiredSatisfied() bool {
 	return true
 }
 
+// IsSupervised if the main process stays our child, simple and notify services
+func (s Service) IsSupervised() bool {
+	return s.Type == "simple" || s.Type == "notify"
+}
+
 // IsService or not
 func (s Service) IsService() bool {
 	return strings.HasSuffix(string(s.Name), ".service")
@@ -365,6 +633,16 @@ func (s Service) IsTarget() bool {
 	return strings.HasSuffix(string(s.Name), ".target")
 }
 
+// hasJob if it is started at boot and stopped at shutdown: services, and the units starting them
+func (s Service) hasJob() bool {
+	return s.IsService() || s.IsSocket() || s.IsTimer() || s.IsPath()
+}
+
+// IsTemplate or not, foo@.service only runs as instances started by its Accept socket
+func (s Service) IsTemplate() bool {
+	return strings.HasSuffix(string(s.Name), "@.service")
+}
+
 func getProcessPid(s *Service) (pid int, err error) {
 	d, err := ioutil.ReadFile(s.PIDFile)
 	if err != nil {
@@ -396,30 +674,99 @@ func processAliveByPid(pid int) (alive bool, err error) {
 func processAliveByCmd(command string) (alive bool, err error) {
 	cmd := exec.Command("sh", "-c", command)
 
-	if err = cmd.Run(); err != nil {
+	if err = runChild(cmd); err != nil {
+		// did the command fail because of an unsuccessful exit code
+		if _, ok := err.(*ExitError); ok {
+			return false, nil
+		}
 		return false, err
 	}
-	// did the command fail because of an unsuccessful exit code
-	if _, ok := err.(*exec.ExitError); ok {
-		return false, nil
-	}
 
 	return true, nil
 }
 
-// justExecACommand of the specified service
-func justExecACommand(command string) (err error) {
-	cmd := exec.Command("sh", "-c", command)
+// command prepares one of the Exec commands of the service, with its outputs and in its own
+// process group, for KillMode=process-group
+func (s Service) command(command Command) (*exec.Cmd, error) {
+	// Only the main command gets the sockets of its socket units, from fd 3
+	var listenFiles []*os.File
+	var listenNames []string
+	if command == s.ExecStart {
+		listenFiles, listenNames = socketFiles(s.Name)
+	}
 
-	if err = cmd.Run(); err != nil {
-		return err
+	line := command.String()
+	if len(listenFiles) > 0 {
+		// LISTEN_PID must be the one of the command, not of a shell waiting for it
+		line = "exec " + line
 	}
-	// did the command fail because of an unsuccessful exit code
-	if _, ok := err.(*exec.ExitError); ok {
-		return nil
+	if s.UMask != "" {
+		// The umask of lutrainit is shared by all its goroutines, let the shell set it
+		line = fmt.Sprintf("umask %s; %s", s.UMask, line)
 	}
+	cmd := exec.Command("sh", "-c", line)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 
-	return nil
+	cred, err := s.credential()
+	if err != nil {
+		return nil, err
+	}
+	cmd.SysProcAttr.Credential = cred
+
+	// Limits and the like must be set in the process, by lutrainit exec-service
+	params := s.execParams(line, cred, len(listenFiles) > 0)
+
+	if cmd.Dir, err = s.workingDirectory(); err != nil {
+		return nil, err
+	}
+	// $VAR in the command are expanded by the shell from there
+	if cmd.Env, err = s.environment(); err != nil {
+		return nil, err
+	}
+	if len(listenFiles) > 0 {
+		cmd.ExtraFiles = listenFiles
+		cmd.Env = append(cmd.Env, fmt.Sprintf("LISTEN_FDS=%d", len(listenFiles)),
+			fmt.Sprintf("LISTEN_FDNAMES=%s", strings.Join(listenNames, ":")))
+	}
+
+	if err = s.joinCgroup(cmd); err != nil {
+		return nil, err
+	}
+	s.setNamespaces(cmd)
+
+	if params != nil {
+		if err = params.wrap(cmd); err != nil {
+			return nil, err
+		}
+	}
+
+	// A nil *os.File must not end up in the io.Writer, exec gives /dev/null only for a nil interface
+	log := getServiceLog(s.Name)
+	stdout, err := log.outputFile(s.StandardOutput)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open StandardOutput %s: %s", s.StandardOutput, err.Error())
+	}
+	if stdout != nil {
+		cmd.Stdout = stdout
+	}
+	stderr, err := log.outputFile(s.StandardError)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open StandardError %s: %s", s.StandardError, err.Error())
+	}
+	if stderr != nil {
+		cmd.Stderr = stderr
+	}
+
+	return cmd, nil
+}
+
+// runCommand runs one of the Exec commands of the service and waits for it
+func (s Service) runCommand(command Command) error {
+	cmd, err := s.command(command)
+	if err != nil {
+		return err
+	}
+	return runChild(cmd)
 }
 
 func checkIfProcessAlive(s *Service) (alive bool, pid int, err error) {
@@ -440,11 +787,19 @@ func checkIfProcessAlive(s *Service) (alive bool, pid int, err error) {
 		return running, pid, nil
 	}
 
-	// TODO: some sort of 'pgrep blah' fork forking types
+	// Whatever it forked is still in its cgroup
+	if !s.IsSupervised() {
+		if pids, err := cgroupProcs(s.Name); err == nil {
+			if len(pids) == 0 {
+				return false, 0, nil
+			}
+			return true, pids[0], nil
+		}
+	}
 
 	// Else if it's a simple, check status from list
-	if s.Type == "simple" {
-		return s.State == Started, 0, nil
+	if s.IsSupervised() {
+		return s.State == Starting || s.State == Started, 0, nil
 	}
 
 	// Cannot determine process state
@@ -453,6 +808,23 @@ func checkIfProcessAlive(s *Service) (alive bool, pid int, err error) {
 
 // CheckAndStartService will check if process alive and start
 func CheckAndStartService(s *Service) (err error) {
+	if s.IsSocket() {
+		return startListening(s)
+	}
+	if s.IsTimer() {
+		return startTimer(s)
+	}
+	if s.IsPath() {
+		return startWatching(s)
+	}
+	if s.IsTemplate() {
+		return fmt.Errorf("%s is a template, its instances are started by its socket", s.Name)
+	}
+	if !s.boundDevicePresent() {
+		return fmt.Errorf("%s cannot start without its device %s", s.Name, s.BindsToDevice)
+	}
+	stopConflicts(s)
+
 	if s.Type != "oneshot" {
 		alive, pid, err := checkIfProcessAlive(s)
 		if err != nil {
@@ -467,7 +839,13 @@ func CheckAndStartService(s *Service) (err error) {
 	}
 
 	// start service
-	if s.Type == "simple" {
+	if s.IsSupervised() {
+		// A manual start gives back a chance to a service which hit its start limit
+		LoadedServicesMu.Lock()
+		LoadedServices[s.Name].RestartTimes = nil
+		setState(s.Name, Starting)
+		LoadedServicesMu.Unlock()
+
 		go s.StartSimple()
 	} else {
 		s.Start()
@@ -476,25 +854,65 @@ func CheckAndStartService(s *Service) (err error) {
 	return nil
 }
 
-// We manage the "cmd" by CheckAndStopService, no simple/forking logic here
-func shutdownProcess(s *Service, cmd string) (err error) {
+// trackedPID returns the PID of the main process of s, or 0 if we don't know it
+func trackedPID(s *Service) int {
+	if s.IsSupervised() {
+		LoadedServicesMu.RLock()
+		defer LoadedServicesMu.RUnlock()
+		return s.LastKnownPID
+	}
+
+	if s.PIDFile != "" {
+		if pid, err := getProcessPid(s); err == nil {
+			return pid
+		}
+	}
+
+	// No PIDFile, any process of the cgroup is better than nothing
+	if pids, err := cgroupProcs(s.Name); err == nil && len(pids) > 0 {
+		return pids[0]
+	}
+	return 0
+}
+
+// stopProcess runs the stop commands of s, then signals what is left of it according to its KillMode
+func stopProcess(s *Service) (err error) {
 	if s.ExecPreStop != "" {
 		LoadedServicesMu.Lock()
 		LoadedServices[s.Name].LastActionAt = time.Now().UTC().Unix()
 		LoadedServices[s.Name].LastAction = PreStop
 		LoadedServicesMu.Unlock()
 
-		err = justExecACommand(s.ExecPreStop.String())
+		err = s.runCommand(s.ExecPreStop)
 		if err != nil {
 			clog.Error(2, "error in %s ExecPreStop: %s", s.Name, err.Error())
 			return err
 		}
 	}
 
-	err = justExecACommand(cmd)
-	if err != nil {
-		return err
+	// Get it before ExecStop, which may remove the PIDFile
+	pid := trackedPID(s)
+
+	if s.ExecStop != "" {
+		err = s.runCommand(s.ExecStop)
+		if err != nil {
+			return err
+		}
+	} else if pid == 0 {
+		return fmt.Errorf("no ExecStop command defined for %s and no known PID, I don't know how to kill it", s.Name)
+	}
+
+	// Whatever survived ExecStop gets signaled
+	if mainRunning(s, pid) || cgroupPopulated(s) {
+		sig, err := killService(s, pid)
+		LoadedServicesMu.Lock()
+		LoadedServices[s.Name].KilledBy = signalName(sig)
+		LoadedServicesMu.Unlock()
+		if err != nil {
+			return err
+		}
 	}
+	defer s.removePrivateTmp()
 
 	if s.ExecPostStop != "" {
 		LoadedServicesMu.Lock()
@@ -502,7 +920,7 @@ func shutdownProcess(s *Service, cmd string) (err error) {
 		LoadedServices[s.Name].LastAction = PostStop
 		LoadedServicesMu.Unlock()
 
-		err = justExecACommand(s.ExecPostStop.String())
+		err = s.runCommand(s.ExecPostStop)
 		if err != nil {
 			clog.Error(2, "error in %s ExecPostStop: %s", s.Name, err.Error())
 			return err
@@ -512,54 +930,100 @@ func shutdownProcess(s *Service, cmd string) (err error) {
 }
 
 // CheckAndStopService will check if process running and stop
+// Like Start(), the lock is not held while the stop commands run.
 func CheckAndStopService(s *Service) (err error) {
+	if s.IsSocket() {
+		return stopListening(s)
+	}
+	if s.IsTimer() {
+		return stopTimer(s)
+	}
+	if s.IsPath() {
+		return stopWatching(s)
+	}
+	stopParts(s)
+
 	// Well, we don't really care if process is running, yeah ?
 	LoadedServicesMu.Lock()
-	defer LoadedServicesMu.Unlock()
-
 	LoadedServices[s.Name].LastActionAt = time.Now().UTC().Unix()
 	LoadedServices[s.Name].LastAction = Stop
+	state := s.State
+	LoadedServicesMu.Unlock()
 
 	// If simple check struct status
-	if s.Type == "simple" {
-		if s.State == Starting || s.State == Started {
-			// kill process according to cmd Shutdown
-			if s.Shutdown != "" {
-				err = shutdownProcess(s, s.Shutdown.String())
-			} else {
-				err = shutdownProcess(s, fmt.Sprintf("pkill %d", s.LastKnownPID))
-			}
-			if err != nil {
-				LoadedServices[s.Name].State = Errored
-				clog.Info("Service %s errored", s.Name)
-				return err
-			}
-			LoadedServices[s.Name].State = Stopped
-			clog.Info("Service %s stopped", s.Name)
-			return err
-		}
-		LoadedServices[s.Name].State = Stopped
+	if s.IsSupervised() && state != Starting && state != Started {
+		LoadedServicesMu.Lock()
+		setState(s.Name, Stopped)
+		LoadedServicesMu.Unlock()
 		clog.Info("Service %s isn't alive", s.Name)
 		return fmt.Errorf("process %s doesn't seems to be alive ?", s.Name)
 	}
 
-	if s.Shutdown != "" {
-		err = shutdownProcess(s, s.Shutdown.String())
-	} else {
-		err = fmt.Errorf("no Shutdown: command defined for %s, I don't know how to kill it", s.Name)
+	// A oneshot without ExecStop doesn't leave anything running
+	if s.Type == "oneshot" && s.ExecStop == "" {
+		LoadedServicesMu.Lock()
+		setState(s.Name, Stopped)
+		LoadedServicesMu.Unlock()
+		clog.Info("Service %s stopped", s.Name)
+		return nil
 	}
+
+	err = stopProcess(s)
+
+	LoadedServicesMu.Lock()
+	defer LoadedServicesMu.Unlock()
 	if err != nil {
-		LoadedServices[s.Name].State = Errored
+		setState(s.Name, Errored)
 		clog.Info("Service %s errored", s.Name)
 		return err
 	}
-	LoadedServices[s.Name].State = Stopped
+	setState(s.Name, Stopped)
 	clog.Info("Service %s stopped", s.Name)
 	return err
 }
 
+// StopServices stops all started or starting services in the reverse order of the boot, each service
+// having up to its TimeoutStop, plus some time for its stop commands, before we go on with the next one
+func StopServices() {
+	if err := SortServicesForBoot(); err != nil {
+		clog.Error(2, "[lutra] Cannot sort services for shutdown: %s", err.Error())
+	}
+
+	for i := len(OrderedTargets) - 1; i >= 0; i-- {
+		services := OrderedServices[OrderedTargets[i]]
+		for j := len(services) - 1; j >= 0; j-- {
+			LoadedServicesMu.RLock()
+			s, exists := LoadedServices[services[j]]
+			// Starting too: a notify service waiting for READY=1, or a restart in progress
+			running := exists && (s.State == Starting || s.State == Started)
+			LoadedServicesMu.RUnlock()
+			if !running || s.Type == "virtual" {
+				continue
+			}
+
+			clog.Info("[lutra] Stopping service %s", s.Name)
+			done := make(chan error, 1)
+			go func(s *Service) {
+				done <- CheckAndStopService(s)
+			}(s)
+
+			select {
+			case err := <-done:
+				if err != nil {
+					clog.Error(2, "[lutra] Error stopping service %s: %s", s.Name, err.Error())
+				}
+			case <-time.After(s.TimeoutStop + serviceStopGrace):
+				clog.Warn("[lutra] Service %s did not stop after %s, going on", s.Name, s.TimeoutStop+serviceStopGrace)
+			}
+		}
+	}
+}
+
 // SortServicesForBoot will sort in the slice and map for targets and services, all ordered
 func SortServicesForBoot() (err error) {
+	OrderedTargets = make([]ServiceName, 0)
+	OrderedServices = make(map[ServiceName][]ServiceName)
+
 	// First step is to sort targets
 	graphTargets := goraph.NewGraph()
 	// Add target nodes
@@ -582,12 +1046,12 @@ func SortServicesForBoot() (err error) {
 			continue // ignore anything is not a target
 		}
 		// WantedBy
-		if s.WantedBy != "" {
-			err = graphTargets.AddEdge(LoadedServices[ServiceName(s.WantedBy)].Node, s.Node, 100)
+		for _, wb := range s.WantedBy {
+			err = graphTargets.AddEdge(LoadedServices[ServiceName(wb)].Node, s.Node, 100)
 			if err == nil {
-				clog.Trace("[target] Added WantedBy edge from '%s' to '%s'", s.WantedBy, s.Name)
+				clog.Trace("[target] Added WantedBy edge from '%s' to '%s'", wb, s.Name)
 			} else {
-				clog.Error(2, "[target] Cannot add WantedBy edge from '%s' to '%s': %s", s.WantedBy, s.Name, err)
+				clog.Error(2, "[target] Cannot add WantedBy edge from '%s' to '%s': %s", wb, s.Name, err)
 			}
 		}
 
@@ -609,8 +1073,8 @@ func SortServicesForBoot() (err error) {
 				clog.Error(2, "[target] Cannot add Before edge from '%s' to '%s': %s", s.Name, bf, err)
 			}
 		}
-		// Requires
-		for _, req := range s.Requires {
+		// Requires, and the other dependencies ordered like it
+		for _, req := range s.orderingDeps() {
 			err := graphTargets.AddEdge(LoadedServices[ServiceName(req)].Node, s.Node, 100)
 			if err == nil {
 				clog.Trace("[target] Added Require edge from '%s' to '%s'", req, s.Name)
@@ -627,16 +1091,19 @@ func SortServicesForBoot() (err error) {
 		return fmt.Errorf("cycle detected")
 	}
 
-	// For each target, process services
+	// Add targets to ordered slice, first for homeTarget
 	for _, target := range listTargets {
-		// Add target to ordered slice
 		OrderedTargets = append(OrderedTargets, ServiceName(target.String()))
+	}
+
+	// For each target, process services
+	for _, target := range listTargets {
 
 		// Now for this target, process services
 		graphServices := goraph.NewGraph()
 		// Add service nodes
 		for _, v := range LoadedServices {
-			if !v.IsService() || v.WantedBy != target.String() {
+			if !v.hasJob() || v.homeTarget() != ServiceName(target.String()) {
 				continue
 			}
 			node := goraph.NewNode(string(v.Name))
@@ -651,7 +1118,7 @@ func SortServicesForBoot() (err error) {
 
 		// Add service edges
 		for _, v := range LoadedServices {
-			if !v.IsService() || v.WantedBy != target.String() {
+			if !v.hasJob() || v.homeTarget() != ServiceName(target.String()) {
 				continue
 			}
 			// After
@@ -672,8 +1139,8 @@ func SortServicesForBoot() (err error) {
 					clog.Error(2, "[service] Cannot add Before edge from '%s' to '%s': %s", v.Name, bf, err)
 				}
 			}
-			// Requires
-			for _, req := range v.Requires {
+			// Requires, and the other dependencies ordered like it
+			for _, req := range v.orderingDeps() {
 				err := graphServices.AddEdge(LoadedServices[ServiceName(req)].Node, v.Node, 100)
 				if err == nil {
 					clog.Trace("[service] Added Require edge from '%s' to '%s'", req, v.Name)
@@ -0,0 +1,530 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/go-clog/clog"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Outputs of the processes of a service, for StandardOutput and StandardError
+const (
+	OutputLog     = "log"     // per-service log file and in-memory tail
+	OutputNull    = "null"    // /dev/null
+	OutputConsole = "console" // the console, like lutrainit itself
+	OutputFile    = "file:"   // prefix of file:PATH, appended to PATH
+)
+
+const (
+	logDateFormat = "2006-01-02"
+	// logLineFormat is the time of the lines in the log files
+	logLineFormat = "2006/01/02 15:04:05"
+	// statusTailLines is how many lines of output lutractl status shows for a failed service
+	statusTailLines = 10
+)
+
+var (
+	// ServiceLogs are the outputs of the services, by service name
+	ServiceLogs = make(map[ServiceName]*ServiceLog)
+	// ServiceLogsMu tex to avoid issues
+	ServiceLogsMu = sync.Mutex{}
+
+	// serviceLogFiles is 0 until the log directory can be written, only the tail is kept before.
+	// Read by the flushes of every service log, it is atomic.
+	serviceLogFiles int32
+)
+
+// LogLine is a line printed by a service
+type LogLine struct {
+	Seq  uint64 // Increasing number of the line in its service log, for lutractl logs -f
+	Time time.Time
+	Text string
+}
+
+func (l LogLine) String() string {
+	return fmt.Sprintf("%s %s", l.Time.Format(logLineFormat), l.Text)
+}
+
+// ServiceLog collects the output of the processes of a service. It is written in its own
+// log file, rotated like the main one, and its last lines are kept in memory.
+type ServiceLog struct {
+	Name ServiceName
+
+	mu sync.Mutex
+
+	writer *os.File            // write end of the pipe given to the processes
+	files  map[string]*os.File // file:PATH outputs
+
+	file     *os.File
+	filename string
+	openDay  int
+	size     int64
+	lines    int64
+
+	seq     uint64    // Seq of the last line
+	tail    []LogLine // ring buffer of the last lines
+	next    int       // where the next line goes in tail
+	pending int       // lines of tail not written to the file yet
+}
+
+// serviceLogTail returns the n last lines printed by a service, nil if it never printed anything
+func serviceLogTail(name ServiceName, n int) []string {
+	ServiceLogsMu.Lock()
+	l, ok := ServiceLogs[name]
+	ServiceLogsMu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	var lines []string
+	for _, line := range l.Tail(n) {
+		lines = append(lines, line.String())
+	}
+	return lines
+}
+
+// checkOutput validates a StandardOutput or StandardError
+func checkOutput(spec string) error {
+	switch {
+	case spec == OutputLog || spec == OutputNull || spec == OutputConsole:
+		return nil
+	case strings.HasPrefix(spec, OutputFile):
+		if !filepath.IsAbs(strings.TrimPrefix(spec, OutputFile)) {
+			return fmt.Errorf("%s is not an absolute path", strings.TrimPrefix(spec, OutputFile))
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown output %s, must be log, file:PATH, null or console", spec)
+}
+
+// getServiceLog returns the log of the service, created if needed
+func getServiceLog(name ServiceName) *ServiceLog {
+	ServiceLogsMu.Lock()
+	defer ServiceLogsMu.Unlock()
+
+	l, ok := ServiceLogs[name]
+	if !ok {
+		l = &ServiceLog{
+			Name:     name,
+			files:    make(map[string]*os.File),
+			filename: filepath.Join(MainConfig.Log.ServicesDir, fmt.Sprintf("%s.log", name)),
+		}
+		ServiceLogs[name] = l
+	}
+	return l
+}
+
+// outputFile returns the file to give to a process for the output spec (StandardOutput or StandardError)
+func (l *ServiceLog) outputFile(spec string) (*os.File, error) {
+	switch {
+	case spec == OutputNull:
+		return nil, nil
+	case spec == OutputConsole:
+		return os.Stderr, nil
+	case strings.HasPrefix(spec, OutputFile):
+		return l.appendFile(strings.TrimPrefix(spec, OutputFile))
+	default:
+		return l.pipe()
+	}
+}
+
+// pipe returns the write end of the pipe read by the service log, created on first use.
+// It stays open, so every process of the service shares it and we never get EOF.
+func (l *ServiceLog) pipe() (*os.File, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.writer != nil {
+		return l.writer, nil
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	l.writer = w
+	go l.read(r)
+
+	return w, nil
+}
+
+func (l *ServiceLog) appendFile(path string) (*os.File, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if f, ok := l.files[path]; ok {
+		return f, nil
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+	l.files[path] = f
+	return f, nil
+}
+
+// read the output of the processes line by line
+func (l *ServiceLog) read(r *os.File) {
+	defer r.Close()
+
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadString('\n')
+		if len(line) > 0 {
+			l.add(LogLine{Time: time.Now(), Text: strings.TrimRight(line, "\r\n")})
+		}
+		if err != nil {
+			if err != io.EOF {
+				clog.Error(2, "[lutra] Cannot read output of %s: %s", l.Name, err.Error())
+			}
+			return
+		}
+	}
+}
+
+func (l *ServiceLog) add(line LogLine) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.seq++
+	line.Seq = l.seq
+
+	size := int(MainConfig.Log.TailLines)
+	if size < 1 {
+		size = 1
+	}
+	if len(l.tail) < size {
+		l.tail = append(l.tail, line)
+		l.next = len(l.tail) % size
+	} else {
+		l.tail[l.next] = line
+		l.next = (l.next + 1) % len(l.tail)
+	}
+	if l.pending < len(l.tail) {
+		l.pending++
+	}
+
+	l.flush()
+}
+
+// Tail returns up to the n last lines, oldest first
+func (l *ServiceLog) Tail(n int) []LogLine {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.lastLines(n)
+}
+
+// Lines returns up to the n last lines printed after the line numbered after and not before since, oldest first.
+// n <= 0 means all of them.
+func (l *ServiceLog) Lines(after uint64, since time.Time, n int) []LogLine {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var lines []LogLine
+	for _, line := range l.lastLines(-1) {
+		if line.Seq > after && !line.Time.Before(since) {
+			lines = append(lines, line)
+		}
+	}
+	if n > 0 && len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return lines
+}
+
+// keptSince tells if the kept lines go back before since, then no line since is only in the files
+func (l *ServiceLog) keptSince(since time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	oldest := l.lastLines(-1)
+	return !since.IsZero() && len(oldest) > 0 && oldest[0].Time.Before(since)
+}
+
+// OlderLines returns up to the n last lines not before since printed before the kept ones, read
+// back from the log files, oldest first. n <= 0 means all of them.
+func (l *ServiceLog) OlderLines(since time.Time, n int) []LogLine {
+	l.mu.Lock()
+	// The kept lines written are the last ones of the files
+	skip := len(l.tail) - l.pending
+	current := int64(0)
+	if fi, err := os.Stat(l.filename); err == nil {
+		current = fi.Size()
+	}
+	rotated, _ := filepath.Glob(fmt.Sprintf("%s.*", l.filename))
+	l.mu.Unlock()
+
+	// Newest first
+	modTimes := make(map[string]time.Time)
+	for _, path := range rotated {
+		if fi, err := os.Stat(path); err == nil {
+			modTimes[path] = fi.ModTime()
+		}
+	}
+	sort.Slice(rotated, func(i, j int) bool {
+		return modTimes[rotated[i]].After(modTimes[rotated[j]])
+	})
+
+	var older []LogLine // newest first
+	for i, path := range append([]string{l.filename}, rotated...) {
+		size := int64(-1)
+		if i == 0 {
+			size = current
+		}
+		lines := readLogFile(path, size)
+		for j := len(lines) - 1; j >= 0; j-- {
+			if skip > 0 {
+				skip--
+				continue
+			}
+			if lines[j].Time.IsZero() && !since.IsZero() {
+				continue
+			}
+			// The older files are older still
+			if lines[j].Time.Before(since) {
+				return reverseLines(older)
+			}
+			older = append(older, lines[j])
+			if n > 0 && len(older) >= n {
+				return reverseLines(older)
+			}
+		}
+	}
+	return reverseLines(older)
+}
+
+// readLogFile returns the lines of a log file, of its size first bytes only if size >= 0.
+// A line without a time is kept with a zero Time.
+func readLogFile(path string, size int64) []LogLine {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if size >= 0 {
+		r = io.LimitReader(f, size)
+	}
+
+	var lines []LogLine
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		text := scanner.Text()
+		line := LogLine{Text: text}
+		if len(text) > len(logLineFormat) {
+			if t, err := time.ParseInLocation(logLineFormat, text[:len(logLineFormat)], time.Local); err == nil {
+				line = LogLine{Time: t, Text: text[len(logLineFormat)+1:]}
+			}
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func reverseLines(lines []LogLine) []LogLine {
+	for i, j := 0, len(lines)-1; i < j; i, j = i+1, j-1 {
+		lines[i], lines[j] = lines[j], lines[i]
+	}
+	return lines
+}
+
+// lastLines returns up to the n last lines, l.mu must be held
+func (l *ServiceLog) lastLines(n int) []LogLine {
+	if n > len(l.tail) || n < 0 {
+		n = len(l.tail)
+	}
+
+	lines := make([]LogLine, 0, n)
+	start := l.next - n
+	if start < 0 {
+		start += len(l.tail)
+	}
+	for i := 0; i < n; i++ {
+		lines = append(lines, l.tail[(start+i)%len(l.tail)])
+	}
+	return lines
+}
+
+// flush the pending lines to the log file, l.mu must be held
+func (l *ServiceLog) flush() {
+	if atomic.LoadInt32(&serviceLogFiles) == 0 || l.pending == 0 {
+		return
+	}
+
+	if l.file == nil {
+		if err := l.openFile(); err != nil {
+			clog.Error(2, "[lutra] Cannot open log of %s: %s", l.Name, err.Error())
+			return
+		}
+	}
+
+	for _, line := range l.lastLines(l.pending) {
+		l.rotate(line.Time)
+
+		n, err := fmt.Fprintln(l.file, line.String())
+		if err != nil {
+			clog.Error(2, "[lutra] Cannot write log of %s: %s", l.Name, err.Error())
+			return
+		}
+		l.size += int64(n)
+		l.lines++
+	}
+	l.pending = 0
+}
+
+func (l *ServiceLog) openFile() (err error) {
+	if err = os.MkdirAll(filepath.Dir(l.filename), 0755); err != nil {
+		return err
+	}
+
+	l.file, err = os.OpenFile(l.filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+
+	fi, err := l.file.Stat()
+	if err != nil {
+		return err
+	}
+	l.size = fi.Size()
+	l.lines = 0
+	l.openDay = fi.ModTime().Day()
+	if l.size == 0 {
+		l.openDay = time.Now().Day()
+	}
+
+	if MainConfig.Log.Rotate && MainConfig.Log.MaxDays > 0 {
+		l.deleteOutdatedFiles()
+	}
+	return nil
+}
+
+// rotate the log file like clog does for the main one, using the [logging] settings
+func (l *ServiceLog) rotate(now time.Time) {
+	if !MainConfig.Log.Rotate {
+		return
+	}
+
+	var rotateDate time.Time
+	if MainConfig.Log.Daily && now.Day() != l.openDay {
+		rotateDate = now.Add(-24 * time.Hour)
+	} else if (MainConfig.Log.MaxSize > 0 && l.size >= 1<<uint(MainConfig.Log.MaxSize)) ||
+		(MainConfig.Log.MaxLines > 0 && l.lines >= MainConfig.Log.MaxLines) {
+		rotateDate = now
+	} else {
+		return
+	}
+
+	l.file.Close()
+	l.file = nil
+	if err := os.Rename(l.filename, l.rotateFilename(rotateDate.Format(logDateFormat))); err != nil {
+		clog.Error(2, "[lutra] Cannot rotate log of %s: %s", l.Name, err.Error())
+	}
+	if err := l.openFile(); err != nil {
+		clog.Error(2, "[lutra] Cannot open log of %s: %s", l.Name, err.Error())
+	}
+	l.openDay = now.Day()
+}
+
+// rotateFilename returns next available rotate filename with given date
+func (l *ServiceLog) rotateFilename(date string) string {
+	filename := fmt.Sprintf("%s.%s", l.filename, date)
+	if _, err := os.Stat(filename); os.IsNotExist(err) {
+		return filename
+	}
+
+	for i := 1; ; i++ {
+		next := fmt.Sprintf("%s.%03d", filename, i)
+		if _, err := os.Stat(next); os.IsNotExist(err) {
+			return next
+		}
+	}
+}
+
+func (l *ServiceLog) deleteOutdatedFiles() {
+	oldest := time.Now().Add(-24 * time.Hour * time.Duration(MainConfig.Log.MaxDays))
+	rotated, _ := filepath.Glob(fmt.Sprintf("%s.*", l.filename))
+	for _, path := range rotated {
+		if fi, err := os.Stat(path); err == nil && fi.ModTime().Before(oldest) {
+			os.Remove(path)
+		}
+	}
+}
+
+// closeFiles closes what is opened on the filesystem, the tail is still kept
+func (l *ServiceLog) closeFiles() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+	for path, f := range l.files {
+		f.Close()
+		delete(l.files, path)
+	}
+}
+
+// closeServiceLog closes the log of a deleted service: our end of its pipe, its reader stops once
+// the processes still writing to it exit, and its files
+func closeServiceLog(name ServiceName) {
+	ServiceLogsMu.Lock()
+	l, ok := ServiceLogs[name]
+	ServiceLogsMu.Unlock()
+	if !ok {
+		return
+	}
+
+	l.mu.Lock()
+	if l.writer != nil {
+		l.writer.Close()
+		l.writer = nil
+	}
+	l.mu.Unlock()
+	l.closeFiles()
+}
+
+// startServiceLogFiles writes the services logs to files from now on, when the log directory is mounted
+func startServiceLogFiles() {
+	ServiceLogsMu.Lock()
+	atomic.StoreInt32(&serviceLogFiles, 1)
+	logs := make([]*ServiceLog, 0, len(ServiceLogs))
+	for _, l := range ServiceLogs {
+		logs = append(logs, l)
+	}
+	ServiceLogsMu.Unlock()
+
+	// Write what has been printed since the boot
+	for _, l := range logs {
+		l.mu.Lock()
+		l.flush()
+		l.mu.Unlock()
+	}
+}
+
+// stopServiceLogFiles closes all the files of the services logs, so the filesystems can be unmounted
+func stopServiceLogFiles() {
+	ServiceLogsMu.Lock()
+	atomic.StoreInt32(&serviceLogFiles, 0)
+	logs := make([]*ServiceLog, 0, len(ServiceLogs))
+	for _, l := range ServiceLogs {
+		logs = append(logs, l)
+	}
+	ServiceLogsMu.Unlock()
+
+	for _, l := range logs {
+		l.closeFiles()
+	}
+}
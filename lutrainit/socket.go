@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"github.com/go-clog/clog"
+	"github.com/go-ini/ini"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Kinds of Listen of the socket units
+const (
+	ListenStream   = "ListenStream"
+	ListenDatagram = "ListenDatagram"
+	ListenFIFO     = "ListenFIFO"
+)
+
+// Listen is a socket opened by a socket unit.
+// Address is a path, an @abstract unix name, a port, or an ip:port.
+type Listen struct {
+	Kind    string
+	Address string
+}
+
+func (l Listen) String() string {
+	return fmt.Sprintf("%s %s", l.Kind, l.Address)
+}
+
+// IsSocket or not
+func (s Service) IsSocket() bool {
+	return strings.HasSuffix(string(s.Name), ".socket")
+}
+
+// isUnix if the address is a path or an abstract name
+func (l Listen) isUnix() bool {
+	return strings.HasPrefix(l.Address, "/") || strings.HasPrefix(l.Address, "@")
+}
+
+// hostPort splits an ip:port or port address, host is empty for all the addresses
+func (l Listen) hostPort() (host string, port int, err error) {
+	portStr := l.Address
+	if !isNumber(l.Address) {
+		if host, portStr, err = net.SplitHostPort(l.Address); err != nil {
+			return "", 0, err
+		}
+		// No name resolution at boot
+		if net.ParseIP(host) == nil {
+			return "", 0, fmt.Errorf("%s is not an IP address", host)
+		}
+	}
+	if port, err = strconv.Atoi(portStr); err != nil || port < 1 || port > 65535 {
+		return "", 0, fmt.Errorf("invalid port %s", portStr)
+	}
+	return host, port, nil
+}
+
+func (l Listen) check() error {
+	if l.Kind == ListenFIFO || l.isUnix() {
+		if l.Kind == ListenFIFO && !filepath.IsAbs(l.Address) {
+			return fmt.Errorf("%s must be an absolute path: %s", l.Kind, l.Address)
+		}
+		return nil
+	}
+	_, _, err := l.hostPort()
+	return err
+}
+
+func isNumber(s string) bool {
+	_, err := strconv.Atoi(s)
+	return err == nil
+}
+
+// parseSocketUnit parses the [socket] section of a .socket file
+func parseSocketUnit(s Service, cfg *ini.File, fname string) (Service, error) {
+	sec, err := cfg.GetSection("socket")
+	if err != nil {
+		clog.Error(2, "socket %s does not contains a socket section", fname)
+		return s, fmt.Errorf("socket %s does not contains a socket section", fname)
+	}
+
+	s.Type = "socket"
+	s.Description = sec.Key("Description").MustString("")
+	s.AutoStart = sec.Key("Autostart").MustBool(true)
+
+	for _, kind := range []string{ListenStream, ListenDatagram, ListenFIFO} {
+		for _, addr := range sec.Key(kind).ValueWithShadows() {
+			if addr == "" {
+				continue
+			}
+			l := Listen{Kind: kind, Address: addr}
+			if err := l.check(); err != nil {
+				clog.Error(2, "socket %s invalid %s: %s", fname, kind, err.Error())
+				return s, fmt.Errorf("socket %s invalid %s: %s", fname, kind, err.Error())
+			}
+			s.Listen = append(s.Listen, l)
+		}
+	}
+	if len(s.Listen) == 0 {
+		return s, fmt.Errorf("socket %s does not have any Listen", fname)
+	}
+
+	// Accept runs an instance of a foo@.service template per connection
+	s.Accept = sec.Key("Accept").MustBool(false)
+	if s.Accept {
+		for _, l := range s.Listen {
+			if l.Kind != ListenStream {
+				return s, fmt.Errorf("socket %s with Accept can only have ListenStream", fname)
+			}
+		}
+	}
+	s.MaxConnections = sec.Key("MaxConnections").MustInt(64)
+	s.MaxConnectionsPerSource = sec.Key("MaxConnectionsPerSource").MustInt(0)
+	if s.MaxConnections < 1 || s.MaxConnectionsPerSource < 0 {
+		return s, fmt.Errorf("socket %s invalid MaxConnections or MaxConnectionsPerSource", fname)
+	}
+
+	base := strings.TrimSuffix(string(s.Name), ".socket")
+	if s.Accept {
+		s.SocketService = ServiceName(sec.Key("Service").MustString(base + "@.service"))
+	} else {
+		s.SocketService = ServiceName(sec.Key("Service").MustString(base + ".service"))
+	}
+	s.FileDescriptorName = sec.Key("FileDescriptorName").MustString(base)
+	if strings.Contains(s.FileDescriptorName, ":") {
+		return s, fmt.Errorf("socket %s FileDescriptorName cannot contain ':'", fname)
+	}
+
+	mode, err := strconv.ParseUint(sec.Key("SocketMode").MustString("0666"), 8, 32)
+	if err != nil || mode > 0777 {
+		clog.Error(2, "socket %s invalid SocketMode: %s", fname, sec.Key("SocketMode").String())
+		return s, fmt.Errorf("socket %s invalid SocketMode: %s", fname, sec.Key("SocketMode").String())
+	}
+	s.SocketMode = os.FileMode(mode)
+
+	return s, nil
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"fmt"
+	"github.com/go-clog/clog"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// A socket or path unit activating its service more than triggerBurst times in triggerInterval
+// is put in error, its service is most likely failing to start
+const (
+	triggerBurst    = 20
+	triggerInterval = 2 * time.Second
+)
+
+// socketWatch is a listening socket unit: its files and the pipe waking up its watcher.
+// With Accept, the connections being served, in total and by source address, under socketWatchesMu.
+type socketWatch struct {
+	files []*os.File
+	stop  *os.File
+
+	connections int
+	sources     map[string]int
+}
+
+var (
+	socketWatches   = make(map[ServiceName]*socketWatch)
+	socketWatchesMu sync.Mutex
+)
+
+// startListening opens the sockets of the socket unit s and watches them
+func startListening(s *Service) error {
+	LoadedServicesMu.Lock()
+	if s.State == Started {
+		LoadedServicesMu.Unlock()
+		return fmt.Errorf("socket %s is already listening", s.Name)
+	}
+	LoadedServices[s.Name].LastActionAt = time.Now().UTC().Unix()
+	LoadedServices[s.Name].LastAction = Start
+	LoadedServicesMu.Unlock()
+
+	var files []*os.File
+	for _, l := range s.Listen {
+		f, err := listen(l, s.SocketMode)
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			clog.Error(2, "[lutra] Cannot listen on %s for %s: %s", l.String(), s.Name, err.Error())
+			LoadedServicesMu.Lock()
+			setState(s.Name, Errored)
+			LoadedServices[s.Name].LastMessage = fmt.Sprintf("cannot listen on %s: %s", l.String(), err.Error())
+			LoadedServicesMu.Unlock()
+			return fmt.Errorf("cannot listen on %s: %s", l.String(), err.Error())
+		}
+		files = append(files, f)
+	}
+
+	// Listening before the watcher runs, else it would stop on the first activity
+	LoadedServicesMu.Lock()
+	fds := make([]int, 0, len(files))
+	for _, f := range files {
+		fds = append(fds, int(f.Fd()))
+	}
+	LoadedServices[s.Name].ListenFDs = fds
+	LoadedServices[s.Name].TriggerTimes = nil
+	LoadedServices[s.Name].LastMessage = ""
+	setState(s.Name, Started)
+	LoadedServicesMu.Unlock()
+
+	if err := watchSocket(s.Name, files); err != nil {
+		for _, f := range files {
+			f.Close()
+		}
+		LoadedServicesMu.Lock()
+		setState(s.Name, Errored)
+		LoadedServices[s.Name].ListenFDs = nil
+		LoadedServices[s.Name].LastMessage = err.Error()
+		LoadedServicesMu.Unlock()
+		return err
+	}
+
+	clog.Info("[lutra] Socket %s listening for %s", s.Name, s.SocketService)
+	return nil
+}
+
+// stopListening closes the sockets of the socket unit s, its service keeps running
+func stopListening(s *Service) error {
+	closeSocket(s.Name)
+
+	LoadedServicesMu.Lock()
+	defer LoadedServicesMu.Unlock()
+	LoadedServices[s.Name].LastActionAt = time.Now().UTC().Unix()
+	LoadedServices[s.Name].LastAction = Stop
+	LoadedServices[s.Name].ListenFDs = nil
+	setState(s.Name, Stopped)
+	clog.Info("Socket %s stopped", s.Name)
+	return nil
+}
+
+// closeSocket closes the files of a socket unit and stops its watcher
+func closeSocket(name ServiceName) {
+	socketWatchesMu.Lock()
+	w, ok := socketWatches[name]
+	delete(socketWatches, name)
+	socketWatchesMu.Unlock()
+	if !ok {
+		return
+	}
+
+	w.stop.Write([]byte{0})
+	w.stop.Close()
+	for _, f := range w.files {
+		f.Close()
+	}
+}
+
+// listen opens the socket or the FIFO of l, blocking, as the services expect them
+func listen(l Listen, mode os.FileMode) (*os.File, error) {
+	if l.Kind == ListenFIFO {
+		return listenFIFO(l.Address, mode)
+	}
+
+	domain, sa, err := l.sockaddr()
+	if err != nil {
+		return nil, err
+	}
+	typ := syscall.SOCK_STREAM
+	if l.Kind == ListenDatagram {
+		typ = syscall.SOCK_DGRAM
+	}
+
+	fd, err := syscall.Socket(domain, typ|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	f := os.NewFile(uintptr(fd), l.String())
+
+	switch {
+	case domain != syscall.AF_UNIX:
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+			f.Close()
+			return nil, err
+		}
+		// A port alone is for both IPv4 and IPv6
+		if isNumber(l.Address) {
+			if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, 0); err != nil {
+				f.Close()
+				return nil, err
+			}
+		}
+	case l.Address[0] == '/':
+		if err := os.MkdirAll(filepath.Dir(l.Address), 0755); err != nil {
+			f.Close()
+			return nil, err
+		}
+		// Left by a previous boot
+		if fi, err := os.Lstat(l.Address); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(l.Address)
+		}
+	}
+
+	if err := syscall.Bind(fd, sa); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if l.Address[0] == '/' {
+		if err := os.Chmod(l.Address, mode); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	if typ == syscall.SOCK_STREAM {
+		if err := syscall.Listen(fd, syscall.SOMAXCONN); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// sockaddr of a stream or datagram Listen, the @ of abstract names is handled by syscall
+func (l Listen) sockaddr() (int, syscall.Sockaddr, error) {
+	if l.isUnix() {
+		return syscall.AF_UNIX, &syscall.SockaddrUnix{Name: l.Address}, nil
+	}
+
+	host, port, err := l.hostPort()
+	if err != nil {
+		return 0, nil, err
+	}
+	if host == "" {
+		return syscall.AF_INET6, &syscall.SockaddrInet6{Port: port}, nil
+	}
+	ip := net.ParseIP(host)
+	if ip4 := ip.To4(); ip4 != nil {
+		sa := &syscall.SockaddrInet4{Port: port}
+		copy(sa.Addr[:], ip4)
+		return syscall.AF_INET, sa, nil
+	}
+	sa := &syscall.SockaddrInet6{Port: port}
+	copy(sa.Addr[:], ip.To16())
+	return syscall.AF_INET6, sa, nil
+}
+
+// listenFIFO creates the FIFO if needed and opens it read-write, so it never sees an end of file
+func listenFIFO(path string, mode os.FileMode) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	if err := syscall.Mkfifo(path, uint32(mode)); err != nil && err != syscall.EEXIST {
+		return nil, err
+	}
+	if fi, err := os.Stat(path); err != nil {
+		return nil, err
+	} else if fi.Mode()&os.ModeNamedPipe == 0 {
+		return nil, fmt.Errorf("%s exists and is not a FIFO", path)
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		return nil, err
+	}
+
+	// Not os.OpenFile, which would make it non-blocking for its poller
+	fd, err := syscall.Open(path, syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), fmt.Sprintf("%s %s", ListenFIFO, path)), nil
+}
+
+// watchSocket starts the watcher of the files of a socket unit, it runs until closeSocket
+func watchSocket(name ServiceName, files []*os.File) error {
+	stopR, stopW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+
+	w := &socketWatch{files: files, stop: stopW, sources: make(map[string]int)}
+	socketWatchesMu.Lock()
+	socketWatches[name] = w
+	socketWatchesMu.Unlock()
+
+	go func() {
+		defer stopR.Close()
+		if err := waitSockets(name, w, stopR); err != nil {
+			clog.Error(2, "[lutra] Cannot watch socket %s: %s", name, err.Error())
+			LoadedServicesMu.Lock()
+			setState(name, Errored)
+			LoadedServices[name].LastMessage = err.Error()
+			LoadedServicesMu.Unlock()
+			closeSocket(name)
+		}
+	}()
+	return nil
+}
+
+// waitSockets activates the service of the socket unit name each time one of its files is
+// readable while the service isn't running, or accepts the connections with Accept, until
+// stop is written to
+func waitSockets(name ServiceName, w *socketWatch, stop *os.File) error {
+	files := w.files
+	LoadedServicesMu.RLock()
+	accept := LoadedServices[name].Accept
+	LoadedServicesMu.RUnlock()
+
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(epfd)
+
+	for _, f := range append([]*os.File{stop}, files...) {
+		fd := int(f.Fd())
+		if err := syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, fd, &syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(fd)}); err != nil {
+			return err
+		}
+	}
+
+	stopFd := int32(stop.Fd())
+	events := make([]syscall.EpollEvent, len(files)+1)
+	for {
+		n, err := syscall.EpollWait(epfd, events, -1)
+		if err == syscall.EINTR {
+			continue
+		} else if err != nil {
+			return err
+		}
+		for _, ev := range events[:n] {
+			if ev.Fd == stopFd {
+				return nil
+			}
+		}
+		if accept {
+			for _, ev := range events[:n] {
+				acceptConnection(name, w, int(ev.Fd))
+			}
+			continue
+		}
+		if !activateSocket(name) {
+			return nil
+		}
+	}
+}
+
+// activateSocket starts the service of the socket unit name and waits until it isn't running
+// anymore, to watch the sockets again. It returns false when the socket unit isn't listening.
+func activateSocket(name ServiceName) bool {
+	LoadedServicesMu.Lock()
+	defer LoadedServicesMu.Unlock()
+
+	sock := LoadedServices[name]
+	if sock.State != Started || ShuttingDown {
+		return false
+	}
+	s, ok := LoadedServices[sock.SocketService]
+	if !ok {
+		failSocket(sock, fmt.Sprintf("service %s doesn't exist", sock.SocketService))
+		return false
+	}
+
+	// A oneshot done is started again
+	if !s.running() {
+		if tooManyTriggers(sock) {
+			failSocket(sock, fmt.Sprintf("triggered %s more than %d times in %s", s.Name, triggerBurst, triggerInterval))
+			return false
+		}
+
+		clog.Info("[lutra] Activity on socket %s, starting %s", name, s.Name)
+		launch(s)
+	}
+
+	for sock.State == Started && s.running() {
+		serviceStateChanged.Wait()
+	}
+	return sock.State == Started
+}
+
+// tooManyTriggers records an activation by the unit u, and tells if it is over triggerBurst.
+// LoadedServicesMu must be held.
+func tooManyTriggers(u *Service) bool {
+	now := time.Now()
+	times := make([]time.Time, 0, len(u.TriggerTimes)+1)
+	for _, t := range u.TriggerTimes {
+		if now.Sub(t) < triggerInterval {
+			times = append(times, t)
+		}
+	}
+	u.TriggerTimes = append(times, now)
+	return len(u.TriggerTimes) > triggerBurst
+}
+
+// failSocket puts the socket unit in error and closes its files, LoadedServicesMu must be held
+func failSocket(sock *Service, reason string) {
+	clog.Error(2, "[lutra] Socket %s failed: %s", sock.Name, reason)
+	setState(sock.Name, Errored)
+	sock.LastMessage = reason
+	sock.ListenFDs = nil
+	closeSocket(sock.Name)
+}
+
+// socketFiles returns the files given to the service name by its listening socket units, with
+// their FileDescriptorName, in the order of the names of the units
+func socketFiles(name ServiceName) (files []*os.File, names []string) {
+	LoadedServicesMu.RLock()
+	var sockets []*Service
+	for _, s := range LoadedServices {
+		// Instances of Accept ones get their connection instead
+		if s.IsSocket() && s.SocketService == name && s.State == Started && !s.Accept {
+			sockets = append(sockets, s)
+		}
+	}
+	LoadedServicesMu.RUnlock()
+	sort.Slice(sockets, func(i, j int) bool {
+		return sockets[i].Name < sockets[j].Name
+	})
+
+	socketWatchesMu.Lock()
+	defer socketWatchesMu.Unlock()
+	for _, s := range sockets {
+		w, ok := socketWatches[s.Name]
+		if !ok {
+			continue
+		}
+		for _, f := range w.files {
+			files = append(files, f)
+			names = append(names, s.FileDescriptorName)
+		}
+	}
+	return files, names
+}
+
+// keepSocketsOnExec lets the listening sockets survive the exec of ReExecInit, their numbers
+// are in the serialized services
+func keepSocketsOnExec() {
+	LoadedServicesMu.RLock()
+	defer LoadedServicesMu.RUnlock()
+	for _, s := range LoadedServices {
+		for _, fd := range s.ListenFDs {
+			syscall.Syscall(syscall.SYS_FCNTL, uintptr(fd), syscall.F_SETFD, 0)
+		}
+	}
+}
+
+// restoreSockets watches again the sockets kept through a reexec
+func restoreSockets() {
+	LoadedServicesMu.RLock()
+	var sockets []*Service
+	for _, s := range LoadedServices {
+		if s.IsSocket() && s.State == Started && len(s.ListenFDs) > 0 {
+			sockets = append(sockets, s)
+		}
+	}
+	LoadedServicesMu.RUnlock()
+
+	for _, s := range sockets {
+		files := make([]*os.File, 0, len(s.ListenFDs))
+		for i, fd := range s.ListenFDs {
+			syscall.CloseOnExec(fd)
+			fileName := fmt.Sprintf("%s %d", s.Name, i)
+			if i < len(s.Listen) {
+				fileName = s.Listen[i].String()
+			}
+			files = append(files, os.NewFile(uintptr(fd), fileName))
+		}
+		if err := watchSocket(s.Name, files); err != nil {
+			clog.Error(2, "[lutra] Cannot watch socket %s again: %s", s.Name, err.Error())
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"github.com/go-clog/clog"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+var (
+	// childrenMu protects children. It is held while starting a process, so the supervisor
+	// cannot reap it before we know who it belongs to.
+	childrenMu = sync.Mutex{}
+	// children are the processes we started and wait for, by PID
+	children = make(map[int]chan syscall.WaitStatus)
+	// supervisorStarted is false when we don't run as init, then exec.Cmd.Wait() is used
+	supervisorStarted = false
+)
+
+// Child is a process we started, its exit status is given by the supervisor
+type Child struct {
+	Cmd    *exec.Cmd
+	exited chan syscall.WaitStatus
+}
+
+// ExitError is returned when a child didn't exit successfully
+type ExitError struct {
+	Status syscall.WaitStatus
+}
+
+func (e *ExitError) Error() string {
+	if e.Status.Signaled() {
+		return fmt.Sprintf("killed by signal %s", signalName(e.Status.Signal()))
+	}
+	return fmt.Sprintf("exit status %d", e.Status.ExitStatus())
+}
+
+// startSupervisor handles SIGCHLD in the background, reaping every child and orphan.
+// Every process must then be started with startChild, or its exit status will be lost.
+func startSupervisor() {
+	sigs := make(chan os.Signal, 16)
+	signal.Notify(sigs, syscall.SIGCHLD)
+
+	childrenMu.Lock()
+	supervisorStarted = true
+	childrenMu.Unlock()
+
+	go func() {
+		for {
+			reapChildren()
+			<-sigs
+		}
+	}()
+}
+
+// reapChildren reaps all the exited processes, and gives their exit status to whoever started them.
+// Several SIGCHLD may be merged into one, so we reap until there is nothing left.
+func reapChildren() {
+	childrenMu.Lock()
+	defer childrenMu.Unlock()
+
+	for {
+		var status syscall.WaitStatus
+		pid, err := syscall.Wait4(-1, &status, syscall.WNOHANG, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil || pid <= 0 {
+			return
+		}
+
+		if exited, ok := children[pid]; ok {
+			delete(children, pid)
+			exited <- status
+		} else {
+			// Double forked daemons and the orphans of dead processes
+			clog.Trace("[lutra] Reaped orphan process %d", pid)
+		}
+	}
+}
+
+// startChild starts cmd, its Stdin, Stdout and Stderr must be nil or *os.File as
+// exec.Cmd.Wait() is never called.
+func startChild(cmd *exec.Cmd) (*Child, error) {
+	childrenMu.Lock()
+	defer childrenMu.Unlock()
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	child := &Child{Cmd: cmd}
+	if supervisorStarted {
+		child.exited = make(chan syscall.WaitStatus, 1)
+		children[cmd.Process.Pid] = child.exited
+	}
+	return child, nil
+}
+
+// Wait for the child to exit, returns an *ExitError if it failed
+func (c *Child) Wait() error {
+	var status syscall.WaitStatus
+
+	if c.exited == nil {
+		err := c.Cmd.Wait()
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok {
+			return err
+		}
+		status = exitErr.Sys().(syscall.WaitStatus)
+	} else {
+		status = <-c.exited
+	}
+
+	if status.Exited() && status.ExitStatus() == 0 {
+		return nil
+	}
+	return &ExitError{Status: status}
+}
+
+// runChild starts cmd and waits for it to exit
+func runChild(cmd *exec.Cmd) error {
+	child, err := startChild(cmd)
+	if err != nil {
+		return err
+	}
+	return child.Wait()
+}
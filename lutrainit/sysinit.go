@@ -40,6 +40,9 @@ func setupLogging(withFile bool) (err error) {
 		if err != nil {
 			clog.Error(2, "Cannot initialize log to file: %s", err.Error())
 		}
+
+		// The services logs go in the same place
+		startServiceLogFiles()
 	}
 	return err
 }
@@ -21,13 +21,13 @@ func run(cmd string, args ...string) error {
 	c.Stdout = os.Stdout
 	c.Stdin = os.Stdin
 	c.Stderr = os.Stderr
-	return c.Run()
+	return runChild(c)
 }
 
 // Runs a command and waits for it to finish.
 func runquiet(cmd string, args ...string) error {
 	c := exec.Command(cmd, args...)
-	return c.Run()
+	return runChild(c)
 }
 
 // SetHostname set the hostname
@@ -76,6 +76,10 @@ func sysinit(ctx *cli.Context) error {
 		os.Exit(-1)
 	}
 
+	// Reap every process, and route their exit status to the services and gettys they belong to.
+	// Must be started before we run anything.
+	startSupervisor()
+
 	// First of all, we need to be sure we have a correct PATH setted
 	// This is useful if we use lutrainit in an initramfs since PATH would be unset
 	curEnvPath := os.Getenv("PATH")
@@ -143,12 +147,22 @@ func sysinit(ctx *cli.Context) error {
 		Mount("tmpfs", "shm", "/dev/shm", "mode=1777,nosuid,nodev")
 	}
 
+	// Every service gets its own cgroup
+	setupCgroups()
+
 	// Parse configurations, reexec is counted as reloading
 	ReloadConfig(MainConfig.StartedReexec, "/etc/lutrainit/", false)
 
+	// Before the boot, the services of the devices present are started with the others
+	startDeviceMonitor()
+
 	if !MainConfig.StartedReexec {
 		// Start all services from StartupServices in the right Requires order
 		StartServices()
+	} else {
+		restoreSockets()
+		restoreTimers()
+		restorePaths()
 	}
 
 	// the log directory could be mounted separated or tmpfs
@@ -158,9 +172,6 @@ func sysinit(ctx *cli.Context) error {
 		clog.Error(2, "Failed to add file logging to logger: %s", err.Error())
 	}
 
-	// Kick Zombies out in the background
-	go reapChildren()
-
 	ManageGettys()
 
 	// The ttys exited. Kill processes, unmount filesystems and halt the system.
@@ -286,6 +297,7 @@ func ReExecInit() {
 
 	// Prepare new environment
 	os.Setenv("LUTRAINIT_REEXECING", "true")
+	keepSocketsOnExec()
 
 	if err := syscall.Exec(os.Args[0], os.Args, os.Environ()); err != nil {
 		fmt.Println("reexec failed:", err)
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"fmt"
+	"github.com/go-clog/clog"
+	"github.com/go-ini/ini"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// timerStampDir keeps the last trigger of the Persistent timers across reboots
+	timerStampDir = "/var/lib/lutrainit/timers"
+	// timerCheckInterval is how often a timer checks the clock while waiting, which may jump
+	timerCheckInterval = time.Minute
+)
+
+var (
+	timerStops   = make(map[ServiceName]chan struct{})
+	timerStopsMu sync.Mutex
+)
+
+// IsTimer or not
+func (s Service) IsTimer() bool {
+	return strings.HasSuffix(string(s.Name), ".timer")
+}
+
+// parseTimerUnit parses the [timer] section of a .timer file
+func parseTimerUnit(s Service, cfg *ini.File, fname string) (Service, error) {
+	sec, err := cfg.GetSection("timer")
+	if err != nil {
+		clog.Error(2, "timer %s does not contains a timer section", fname)
+		return s, fmt.Errorf("timer %s does not contains a timer section", fname)
+	}
+
+	s.Type = "timer"
+	s.Description = sec.Key("Description").MustString("")
+	s.AutoStart = sec.Key("Autostart").MustBool(true)
+
+	for _, spec := range sec.Key("OnCalendar").ValueWithShadows() {
+		if strings.TrimSpace(spec) == "" {
+			continue
+		}
+		if _, err := parseCalendar(spec); err != nil {
+			clog.Error(2, "timer %s: %s", fname, err.Error())
+			return s, fmt.Errorf("timer %s: %s", fname, err.Error())
+		}
+		s.OnCalendar = append(s.OnCalendar, spec)
+	}
+	s.OnBootSec = mustSeconds(sec.Key("OnBootSec"), 0)
+	s.OnUnitActiveSec = mustSeconds(sec.Key("OnUnitActiveSec"), 0)
+	s.RandomizedDelaySec = mustSeconds(sec.Key("RandomizedDelaySec"), 0)
+	s.Persistent = sec.Key("Persistent").MustBool(false)
+	// OnUnitActiveSec only repeats the first trigger
+	if len(s.OnCalendar) == 0 && s.OnBootSec == 0 {
+		return s, fmt.Errorf("timer %s needs OnCalendar or OnBootSec", fname)
+	}
+
+	base := strings.TrimSuffix(string(s.Name), ".timer")
+	s.TimerService = ServiceName(sec.Key("Unit").MustString(base + ".service"))
+
+	return s, nil
+}
+
+// nextElapse of the timer s after now, zero if it won't elapse anymore.
+// OnBootSec elapses once, OnUnitActiveSec after each trigger, and OnCalendar missed while
+// lutrainit wasn't running elapse right away when Persistent.
+func (s Service) nextElapse(now time.Time) time.Time {
+	var next time.Time
+	consider := func(c time.Time) {
+		if !c.IsZero() && (next.IsZero() || c.Before(next)) {
+			next = c
+		}
+	}
+
+	after := now
+	if s.Persistent && !s.LastTrigger.IsZero() {
+		after = s.LastTrigger
+	}
+	for _, spec := range s.OnCalendar {
+		if c, err := parseCalendar(spec); err == nil {
+			consider(c.next(after.In(time.Local)))
+		}
+	}
+
+	if s.OnBootSec > 0 {
+		if boot := bootTime().Add(s.OnBootSec); s.LastTrigger.Before(boot) {
+			consider(boot)
+		}
+	}
+	if s.OnUnitActiveSec > 0 && !s.LastTrigger.IsZero() {
+		consider(s.LastTrigger.Add(s.OnUnitActiveSec))
+	}
+
+	if !next.IsZero() && s.RandomizedDelaySec > 0 {
+		next = next.Add(time.Duration(rand.Int63n(int64(s.RandomizedDelaySec))))
+	}
+	return next
+}
+
+// startTimer arms the timer unit s
+func startTimer(s *Service) error {
+	LoadedServicesMu.Lock()
+	if s.State == Started {
+		LoadedServicesMu.Unlock()
+		return fmt.Errorf("timer %s is already started", s.Name)
+	}
+	LoadedServices[s.Name].LastActionAt = time.Now().UTC().Unix()
+	LoadedServices[s.Name].LastAction = Start
+	LoadedServices[s.Name].LastMessage = ""
+	LoadedServices[s.Name].NextElapse = time.Time{}
+	if s.Persistent && s.LastTrigger.IsZero() {
+		LoadedServices[s.Name].LastTrigger = readTimerStamp(s.Name)
+	}
+	setState(s.Name, Started)
+	LoadedServicesMu.Unlock()
+
+	runTimer(s.Name)
+	clog.Info("[lutra] Timer %s started for %s", s.Name, s.TimerService)
+	return nil
+}
+
+// stopTimer disarms the timer unit s, a service it started keeps running
+func stopTimer(s *Service) error {
+	timerStopsMu.Lock()
+	if stop, ok := timerStops[s.Name]; ok {
+		close(stop)
+		delete(timerStops, s.Name)
+	}
+	timerStopsMu.Unlock()
+
+	LoadedServicesMu.Lock()
+	defer LoadedServicesMu.Unlock()
+	LoadedServices[s.Name].LastActionAt = time.Now().UTC().Unix()
+	LoadedServices[s.Name].LastAction = Stop
+	LoadedServices[s.Name].NextElapse = time.Time{}
+	setState(s.Name, Stopped)
+	clog.Info("Timer %s stopped", s.Name)
+	return nil
+}
+
+// restoreTimers runs again the timers started before a reexec
+func restoreTimers() {
+	LoadedServicesMu.RLock()
+	var names []ServiceName
+	for name, s := range LoadedServices {
+		if s.IsTimer() && s.State == Started {
+			names = append(names, name)
+		}
+	}
+	LoadedServicesMu.RUnlock()
+
+	for _, name := range names {
+		runTimer(name)
+	}
+}
+
+// runTimer starts the goroutine waiting for the elapses of the timer name, until stopTimer
+func runTimer(name ServiceName) {
+	stop := make(chan struct{})
+	timerStopsMu.Lock()
+	timerStops[name] = stop
+	timerStopsMu.Unlock()
+
+	go func() {
+		idle := false
+		for {
+			// NextElapse is kept until the trigger, or a reload, for its random delay
+			LoadedServicesMu.Lock()
+			t := LoadedServices[name]
+			if t.NextElapse.IsZero() {
+				t.NextElapse = t.nextElapse(time.Now())
+			}
+			next := t.NextElapse
+			LoadedServicesMu.Unlock()
+
+			// Still checked each timerCheckInterval, a reload may give it a new schedule
+			if next.IsZero() && !idle {
+				clog.Info("[lutra] Timer %s won't elapse anymore", name)
+			}
+			idle = next.IsZero()
+
+			wait := timerCheckInterval
+			if !next.IsZero() && time.Until(next) < wait {
+				wait = time.Until(next)
+			}
+			select {
+			case <-stop:
+				return
+			case <-time.After(wait):
+			}
+
+			if !next.IsZero() && !time.Now().Before(next) {
+				triggerTimer(name)
+			}
+		}
+	}()
+}
+
+// triggerTimer starts the service of the timer name, unless it is still running.
+// A oneshot done is started again.
+func triggerTimer(name ServiceName) {
+	LoadedServicesMu.Lock()
+	t := LoadedServices[name]
+	if t.State != Started || ShuttingDown {
+		LoadedServicesMu.Unlock()
+		return
+	}
+	now := time.Now()
+	t.LastTrigger = now
+	t.NextElapse = time.Time{}
+	persistent := t.Persistent
+
+	s, ok := LoadedServices[t.TimerService]
+	switch {
+	case !ok:
+		t.LastMessage = fmt.Sprintf("service %s doesn't exist", t.TimerService)
+		s = nil
+	case s.State == Starting || (s.State == Started && s.Type != "oneshot"):
+		clog.Info("[lutra] Timer %s elapsed but %s is still running", name, s.Name)
+		s = nil
+	case s.State == Started:
+		setState(s.Name, Stopped)
+	}
+	LoadedServicesMu.Unlock()
+
+	if persistent {
+		writeTimerStamp(name, now)
+	}
+	if s == nil {
+		return
+	}
+
+	clog.Info("[lutra] Timer %s elapsed, starting %s", name, s.Name)
+	go func() {
+		if err := CheckAndStartService(s); err != nil {
+			clog.Error(2, "[lutra] Timer %s cannot start %s: %s", name, s.Name, err.Error())
+		}
+	}()
+}
+
+// readTimerStamp returns the last trigger of a Persistent timer, zero if unknown
+func readTimerStamp(name ServiceName) time.Time {
+	content, err := ioutil.ReadFile(filepath.Join(timerStampDir, string(name)))
+	if err != nil {
+		return time.Time{}
+	}
+	stamp, err := strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(stamp, 0)
+}
+
+func writeTimerStamp(name ServiceName, at time.Time) {
+	if err := os.MkdirAll(timerStampDir, 0755); err != nil {
+		clog.Error(2, "[lutra] Cannot save the last trigger of %s: %s", name, err.Error())
+		return
+	}
+	stamp := []byte(strconv.FormatInt(at.Unix(), 10) + "\n")
+	if err := ioutil.WriteFile(filepath.Join(timerStampDir, string(name)), stamp, 0644); err != nil {
+		clog.Error(2, "[lutra] Cannot save the last trigger of %s: %s", name, err.Error())
+	}
+}
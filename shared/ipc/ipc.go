@@ -55,6 +55,20 @@ type SysStatus struct {
 	PauseTotalNs string
 	PauseNs      string // circular buffer of recent GC pause times, most recent at [(NumGC+255)%256]
 	NumGC        uint32
+
+	// Resources used by the running services, the biggest memory users first
+	Services []ServiceUsage
+}
+
+// ServiceUsage is what the processes of a service use
+type ServiceUsage struct {
+	Name         ServiceName
+	CPUTime      int64  // User and system CPU time, in nanoseconds
+	Memory       uint64 // Current memory of the cgroup, or resident memory of the processes, in bytes
+	Tasks        int    // Processes and threads
+	IOReadBytes  uint64
+	IOWriteBytes uint64
+	FromCgroup   bool // Else only the known processes are counted
 }
 
 // AskStatus struct with limited service name or asking for all
@@ -84,6 +98,7 @@ const (
 	Reload
 	Restart
 	Forcekill
+	WaitReady
 )
 
 func (la LastAction) String() string {
@@ -108,6 +123,8 @@ func (la LastAction) String() string {
 		return "restart"
 	case Forcekill:
 		return "force kill"
+	case WaitReady:
+		return "waiting for ready notification"
 	default:
 		return "really unknown"
 	}
@@ -159,6 +176,7 @@ func (rs RunState) String() string {
 type ServiceAction struct {
 	Name   string
 	Action LastAction
+	NoDeps bool // Stop or restart only it, not the services requiring it
 }
 
 // ServiceActionAnswer is a service action answer
@@ -167,6 +185,35 @@ type ServiceActionAnswer struct {
 	Action LastAction
 	Err    bool
 	ErrStr string
+	Deps   []string // Stopped, or restarted, with it
+}
+
+// AskLogs for the captured output of services, all of them if Names is empty
+type AskLogs struct {
+	Names []string
+	Lines int   // Only the last lines, 0 for all of them
+	Since int64 // Only lines printed since this timestamp (UTC), 0 for all of them
+
+	// Only lines after these, by service name, to follow the logs
+	After map[string]uint64
+}
+
+// LogLine is a line printed by a service
+type LogLine struct {
+	Service string
+	Seq     uint64
+	Time    int64 // Timestamp in nanoseconds (UTC)
+	Text    string
+}
+
+// AnswerLogs is a logs answer, Lines of all services are sorted by time
+type AnswerLogs struct {
+	Lines []LogLine
+	// Last line sent by service name, to send back in AskLogs.After
+	After map[string]uint64
+
+	Err    bool
+	ErrStr string
 }
 
 // Service represents a struct with usefull infos used for management of services
@@ -182,22 +229,52 @@ type Service struct {
 	LastMessage  string
 	LastKnownPID int
 
-	Type    string // forking or simple
+	Type    string // forking, simple, notify, oneshot or virtual
 	PIDFile string
 
 	Startup    Command
 	Shutdown   Command
 	CheckAlive Command
 
+	Restart      string // Restart policy
+	RestartCount int    // Number of automatic restarts done
+
+	KilledBy string // Signal which ended the process on the last stop
+
+	User          string // Resolved user and group the processes run as, empty for root
+	Group         string
+	CredentialErr string // Why User and Group cannot be resolved
+
+	CapabilityBoundingSet string // Effective one: all, none, or the names of the capabilities
+
+	Listen      []string // What a socket unit listens on
+	Watches     []string // What a path unit watches
+	Devices     []string // BindsToDevice and WantedByDevice, present or missing
+	Triggers    string   // Service started by a socket, timer or path unit
+	Accept      bool     // It runs an instance of Triggers per connection
+	Connections int      // Connections being served by the instances
+
+	LastTrigger int64 // Timestamps of the last and next elapse of a timer unit (UTC), 0 if none
+	NextElapse  int64
+
+	Usage *ServiceUsage // Resources used, nil when it has no process
+
+	LogTail []string // Last lines of output, when the service failed
+
 	Deleted bool
 }
 
 // IsCustASCII is a custom regexp checker for sanity
-var IsCustASCII = regexp.MustCompile(`^[a-zA-Z0-9_\-.]+$`).MatchString
+var IsCustASCII = regexp.MustCompile(`^[a-zA-Z0-9_\-.@]+$`).MatchString
 
 // IsCustASCIISpace is a custom regexp checker for sanity with a space !!!
 var IsCustASCIISpace = regexp.MustCompile(`^[a-zA-Z0-9_\-. ]+$`).MatchString
 
+// IsSupervised if the main process stays a child of the init, simple and notify services
+func (s Service) IsSupervised() bool {
+	return s.Type == "simple" || s.Type == "notify"
+}
+
 // IsService or not
 func (s Service) IsService() bool {
 	return strings.HasSuffix(string(s.Name), ".service")